@@ -0,0 +1,103 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// The token endpoint used when an account file does not name one.
+const defaultTokenURI = "https://accounts.google.com/o/oauth2/token"
+
+// accountFile represents a GCE service account JSON key file, which bundles
+// the client identity and its private key in a single file.
+type accountFile struct {
+	Type         string `json:"type"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	ClientId     string `json:"client_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// loadAccountFile loads the GCE service account JSON key file identified by
+// path.
+func loadAccountFile(path string) (*accountFile, error) {
+	var a *accountFile
+	accountBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(accountBytes, &a)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid JSON: %s", path, err)
+	}
+	if a == nil {
+		return nil, fmt.Errorf("%s does not contain a service account", path)
+	}
+	if a.Type != "" && a.Type != "service_account" {
+		return nil, fmt.Errorf("%s has type %q, expected \"service_account\"", path, a.Type)
+	}
+	if a.ClientEmail == "" {
+		return nil, fmt.Errorf("%s is missing client_email", path)
+	}
+	if a.PrivateKey == "" {
+		return nil, fmt.Errorf("%s is missing private_key", path)
+	}
+	block, _ := pem.Decode([]byte(a.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a valid PEM encoded private_key", path)
+	}
+	pemKey, err := processPEMBlock(block)
+	if err != nil {
+		return nil, fmt.Errorf("%s has an invalid private_key: %s", path, err)
+	}
+	a.PrivateKey = string(pemKey)
+	if a.TokenURI == "" {
+		a.TokenURI = defaultTokenURI
+	}
+	return a, nil
+}
+
+// accountFromClientSecrets builds an *accountFile from the legacy client
+// secrets file and its separately converted PEM private key.
+func accountFromClientSecrets(cs *clientSecrets, pemKey []byte) (*accountFile, error) {
+	if cs == nil || cs.Web.ClientEmail == "" {
+		return nil, errors.New("client secrets file is missing web.client_email")
+	}
+	a := &accountFile{
+		Type:        "service_account",
+		PrivateKey:  string(pemKey),
+		ClientEmail: cs.Web.ClientEmail,
+		ClientId:    cs.Web.ClientId,
+		TokenURI:    cs.Web.TokenURI,
+	}
+	if a.TokenURI == "" {
+		a.TokenURI = defaultTokenURI
+	}
+	return a, nil
+}
+
+// loadLegacyAccount loads the client secrets file and PEM private key pair
+// and returns them as a single *accountFile.
+func loadLegacyAccount(clientSecretsFile, privateKeyFile, passphrase string) (*accountFile, error) {
+	cs, err := loadClientSecrets(clientSecretsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing client secrets file: %s", err)
+	}
+	pemKey, err := processPrivateKeyFile(privateKeyFile, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("Failed loading private key file: %s", err)
+	}
+	a, err := accountFromClientSecrets(cs, pemKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing client secrets file: %s", err)
+	}
+	return a, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testAccountFile returns the fields of a valid service account JSON key
+// file.
+func testAccountFile() map[string]string {
+	return map[string]string{
+		"type":           "service_account",
+		"private_key_id": "1234",
+		"private_key":    testPKCS8Key,
+		"client_email":   "packer@developer.gserviceaccount.com",
+		"client_id":      "packer.apps.googleusercontent.com",
+		"token_uri":      "https://oauth2.example.com/token",
+	}
+}
+
+// writeTempJSON writes v as JSON to a temporary file and returns its path.
+func writeTempJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return writeTempKey(t, b)
+}
+
+func TestLoadAccountFile(t *testing.T) {
+	path := writeTempJSON(t, testAccountFile())
+	defer os.Remove(path)
+
+	a, err := loadAccountFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if a.ClientEmail != "packer@developer.gserviceaccount.com" || a.TokenURI != "https://oauth2.example.com/token" {
+		t.Fatalf("bad account: %#v", a)
+	}
+	assertPKCS1(t, []byte(a.PrivateKey))
+}
+
+func TestLoadAccountFile_defaultTokenURI(t *testing.T) {
+	fields := testAccountFile()
+	delete(fields, "token_uri")
+	path := writeTempJSON(t, fields)
+	defer os.Remove(path)
+
+	a, err := loadAccountFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if a.TokenURI != defaultTokenURI {
+		t.Fatalf("token_uri should default to %s, got %s", defaultTokenURI, a.TokenURI)
+	}
+}
+
+func TestLoadAccountFile_invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(map[string]string)
+		raw    string
+		err    string
+	}{
+		{
+			name: "invalid JSON",
+			raw:  `{"type": "service_account",`,
+			err:  "is not valid JSON",
+		},
+		{
+			name:   "authorized user",
+			change: func(f map[string]string) { f["type"] = "authorized_user" },
+			err:    `has type "authorized_user"`,
+		},
+		{
+			name:   "missing client_email",
+			change: func(f map[string]string) { delete(f, "client_email") },
+			err:    "is missing client_email",
+		},
+		{
+			name:   "missing private_key",
+			change: func(f map[string]string) { delete(f, "private_key") },
+			err:    "is missing private_key",
+		},
+		{
+			name:   "non-PEM private_key",
+			change: func(f map[string]string) { f["private_key"] = "not a key" },
+			err:    "does not contain a valid PEM encoded private_key",
+		},
+	}
+	for _, tc := range cases {
+		var path string
+		if tc.raw != "" {
+			path = writeTempKey(t, []byte(tc.raw))
+		} else {
+			fields := testAccountFile()
+			tc.change(fields)
+			path = writeTempJSON(t, fields)
+		}
+		_, err := loadAccountFile(path)
+		os.Remove(path)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("%s: expected an error containing %q, got: %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestLoadLegacyAccount(t *testing.T) {
+	secrets := map[string]interface{}{
+		"web": map[string]string{
+			"client_email": "packer@developer.gserviceaccount.com",
+			"client_id":    "packer.apps.googleusercontent.com",
+		},
+	}
+	secretsPath := writeTempJSON(t, secrets)
+	defer os.Remove(secretsPath)
+	keyPath := writeTempKey(t, []byte(testPKCS8Key))
+	defer os.Remove(keyPath)
+
+	a, err := loadLegacyAccount(secretsPath, keyPath, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if a.ClientEmail != "packer@developer.gserviceaccount.com" || a.TokenURI != defaultTokenURI {
+		t.Fatalf("bad account: %#v", a)
+	}
+	assertPKCS1(t, []byte(a.PrivateKey))
+
+	_, err = loadLegacyAccount(secretsPath, "missing", "")
+	if err == nil || strings.Count(err.Error(), "Failed loading private key file") != 1 {
+		t.Fatalf("expected a single private key file error, got: %v", err)
+	}
+}
@@ -6,31 +6,64 @@ package googlecompute
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"sort"
 	"strings"
+	"time"
 
-	"code.google.com/p/goauth2/oauth"
-	"code.google.com/p/goauth2/oauth/jwt"
-	"code.google.com/p/google-api-go-client/compute/v1beta16"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 )
 
+// defaultInstanceScopes are the OAuth scopes of the build instance's service
+// account, with the permissions required for creating GCE machine images.
+var defaultInstanceScopes = []string{
+	"https://www.googleapis.com/auth/userinfo.email",
+	"https://www.googleapis.com/auth/compute",
+	"https://www.googleapis.com/auth/devstorage.full_control",
+}
+
+// defaultImageProjects are the public image projects searched, last, for
+// source images given by name.
+var defaultImageProjects = []string{
+	"debian-cloud",
+	"centos-cloud",
+	"coreos-cloud",
+	"opensuse-cloud",
+	"rhel-cloud",
+	"suse-cloud",
+	"ubuntu-os-cloud",
+}
+
 // GoogleComputeClient represents a GCE client.
 type GoogleComputeClient struct {
-	ProjectId     string
-	Service       *compute.Service
-	Zone          string
-	clientSecrets *clientSecrets
+	ProjectId string
+	Service   *compute.Service
+	Zone      string
+	// ImageProjects are additional projects searched for source images
+	// given by name, before ProjectId and defaultImageProjects.
+	ImageProjects []string
+	// retries controls how calls failing with transient errors are
+	// retried. The default policy is used when nil.
+	retries *retryPolicy
+	// cancel, when closed, stops the retries of calls in progress. It is
+	// left nil on the client used by cleanups.
+	cancel <-chan struct{}
 }
 
 // InstanceConfig represents a GCE instance configuration.
 // Used for creating machine instances.
 type InstanceConfig struct {
 	Description       string
-	Image             string
+	Disks             []*compute.AttachedDisk
+	Labels            map[string]string
 	MachineType       string
 	Metadata          *compute.Metadata
+	MinCpuPlatform    string
 	Name              string
 	NetworkInterfaces []*compute.NetworkInterface
+	Scheduling        *compute.Scheduling
 	ServiceAccounts   []*compute.ServiceAccount
 	Tags              *compute.Tags
 }
@@ -38,40 +71,47 @@ type InstanceConfig struct {
 // New initializes and returns a *GoogleComputeClient.
 //
 // The projectId must be the project name, i.e. myproject, not the project
-// number.
-func New(projectId string, zone string, c *clientSecrets, pemKey []byte) (*GoogleComputeClient, error) {
+// number. When endpoint is not empty it replaces the base URL of the Compute
+// API, e.g. https://www.googleapis.com/compute/v1/projects/.
+func New(projectId string, zone string, endpoint string, ts tokenSource) (*GoogleComputeClient, error) {
 	googleComputeClient := &GoogleComputeClient{
 		ProjectId: projectId,
 		Zone:      zone,
 	}
-	// Get the access token.
-	t := jwt.NewToken(c.Web.ClientEmail, scopes(), pemKey)
-	t.ClaimSet.Aud = c.Web.TokenURI
-	httpClient := &http.Client{}
-	token, err := t.Assert(httpClient)
-	if err != nil {
+	// Get the access token. The transport replaces it before it expires, so
+	// this only makes sure the credentials work before the build starts.
+	transport := &tokenTransport{source: ts}
+	if _, err := transport.Token(nil); err != nil {
 		return nil, err
 	}
-	config := &oauth.Config{
-		ClientId: c.Web.ClientId,
-		Scope:    scopes(),
-		TokenURL: c.Web.TokenURI,
-		AuthURL:  c.Web.AuthURI,
-	}
-	transport := &oauth.Transport{Config: config}
-	transport.Token = token
-	s, err := compute.New(transport.Client())
+	s, err := compute.New(&http.Client{Transport: transport})
 	if err != nil {
 		return nil, err
 	}
+	if endpoint != "" {
+		s.BasePath = endpoint
+	}
 	googleComputeClient.Service = s
 	return googleComputeClient, nil
 }
 
+// retry calls f according to the client's retry policy.
+func (g *GoogleComputeClient) retry(name string, idempotent bool, f func() error) error {
+	policy := g.retries
+	if policy == nil {
+		policy = defaultRetryPolicy()
+	}
+	return policy.do(name, idempotent, g.cancel, f)
+}
+
 // GetZone returns a *compute.Zone representing the named zone.
 func (g *GoogleComputeClient) GetZone(name string) (*compute.Zone, error) {
 	zoneGetCall := g.Service.Zones.Get(g.ProjectId, name)
-	zone, err := zoneGetCall.Do()
+	var zone *compute.Zone
+	err := g.retry("GetZone", true, func() (err error) {
+		zone, err = zoneGetCall.Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -81,7 +121,11 @@ func (g *GoogleComputeClient) GetZone(name string) (*compute.Zone, error) {
 // GetMachineType returns a *compute.MachineType representing the named machine type.
 func (g *GoogleComputeClient) GetMachineType(name, zone string) (*compute.MachineType, error) {
 	machineTypesGetCall := g.Service.MachineTypes.Get(g.ProjectId, zone, name)
-	machineType, err := machineTypesGetCall.Do()
+	var machineType *compute.MachineType
+	err := g.retry("GetMachineType", true, func() (err error) {
+		machineType, err = machineTypesGetCall.Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -91,54 +135,188 @@ func (g *GoogleComputeClient) GetMachineType(name, zone string) (*compute.Machin
 	return nil, errors.New("Machine Type does not exist: " + name)
 }
 
-// GetImage returns a *compute.Image representing the named image.
+// GetImage returns a *compute.Image representing the named image. The name
+// may also be a full or partial URL naming the image's project, e.g.
+// projects/debian-cloud/global/images/debian-7-wheezy-v20131014; otherwise
+// each of the image projects is searched in turn.
 func (g *GoogleComputeClient) GetImage(name string) (*compute.Image, error) {
-	var err error
-	var image *compute.Image
-	projects := []string{g.ProjectId, "debian-cloud", "centos-cloud"}
-	for _, project := range projects {
-		imagesGetCall := g.Service.Images.Get(project, name)
-		image, err = imagesGetCall.Do()
-		if image != nil {
-			break
-		}
+	project, name, err := parseImageURL(name, "images")
+	if err != nil {
+		return nil, err
+	}
+	projects := g.imageProjects()
+	if project != "" {
+		projects = []string{project}
 	}
+	return findImage("Image "+name, projects, func(project string) (*compute.Image, error) {
+		imagesGetCall := g.Service.Images.Get(project, name)
+		var image *compute.Image
+		err := g.retry("GetImage", true, func() (err error) {
+			image, err = imagesGetCall.Do()
+			return err
+		})
+		return image, err
+	})
+}
+
+// GetImageFromFamily returns a *compute.Image representing the newest
+// image in the named family that is not deprecated. Like GetImage, the
+// family may be given as a URL, e.g.
+// projects/debian-cloud/global/images/family/debian-7.
+func (g *GoogleComputeClient) GetImageFromFamily(family string) (*compute.Image, error) {
+	project, family, err := parseImageURL(family, "images/family")
 	if err != nil {
 		return nil, err
 	}
-	if image != nil {
-		if image.SelfLink != "" {
+	projects := g.imageProjects()
+	if project != "" {
+		projects = []string{project}
+	}
+	return findImage("Image family "+family, projects, func(project string) (*compute.Image, error) {
+		images, err := g.listImages(project, "family eq "+family)
+		if err != nil {
+			return nil, err
+		}
+		return newestImage(images), nil
+	})
+}
+
+// listImages returns all images in project matching filter.
+func (g *GoogleComputeClient) listImages(project, filter string) ([]*compute.Image, error) {
+	var images []*compute.Image
+	pageToken := ""
+	for {
+		imagesListCall := g.Service.Images.List(project).Filter(filter)
+		if pageToken != "" {
+			imagesListCall.PageToken(pageToken)
+		}
+		var imageList *compute.ImageList
+		err := g.retry("GetImageFromFamily", true, func() (err error) {
+			imageList, err = imagesListCall.Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, imageList.Items...)
+		if imageList.NextPageToken == "" {
+			return images, nil
+		}
+		pageToken = imageList.NextPageToken
+	}
+}
+
+// imageProjects returns the projects searched for source images, in order:
+// ImageProjects, ProjectId, then defaultImageProjects. Each project is only
+// searched once.
+func (g *GoogleComputeClient) imageProjects() []string {
+	projects := make([]string, 0, 1+len(defaultImageProjects)+len(g.ImageProjects))
+	seen := make(map[string]bool)
+	for _, list := range [][]string{g.ImageProjects, {g.ProjectId}, defaultImageProjects} {
+		for _, project := range list {
+			if !seen[project] {
+				seen[project] = true
+				projects = append(projects, project)
+			}
+		}
+	}
+	return projects
+}
+
+// findImage calls get with each project in turn and returns the first image
+// found. If there is none, the error lists every project tried along with
+// any error other than the image not being found.
+func findImage(what string, projects []string, get func(project string) (*compute.Image, error)) (*compute.Image, error) {
+	tried := make([]string, 0, len(projects))
+	for _, project := range projects {
+		image, err := get(project)
+		if err == nil && image != nil {
 			return image, nil
 		}
+		if err != nil && !isNotFound(err) {
+			tried = append(tried, fmt.Sprintf("%s (%s)", project, err))
+		} else {
+			tried = append(tried, project)
+		}
 	}
-	return nil, errors.New("Image does not exist: " + name)
+	return nil, fmt.Errorf("%s was not found in projects: %s", what, strings.Join(tried, ", "))
+}
+
+// parseImageURL splits a full or partial URL of a resource in the global
+// collection, such as
+// https://www.googleapis.com/compute/v1/projects/debian-cloud/global/images/debian-7-wheezy-v20131014,
+// into its project and name. A plain name is returned with an empty project.
+func parseImageURL(s, collection string) (project, name string, err error) {
+	if !strings.Contains(s, "/") {
+		return "", s, nil
+	}
+	parts := strings.Split(strings.Trim(s, "/"), "/")
+	suffix := append([]string{"global"}, strings.Split(collection, "/")...)
+	n := len(parts) - len(suffix) - 1
+	if n < 2 || parts[n-2] != "projects" || strings.Join(parts[n:len(parts)-1], "/") != strings.Join(suffix, "/") {
+		return "", "", fmt.Errorf("Invalid image URL %q: must name projects/PROJECT/%s/NAME", s, strings.Join(suffix, "/"))
+	}
+	return parts[n-1], parts[len(parts)-1], nil
+}
+
+// isNotFound reports whether err is an API error for a missing resource.
+func isNotFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
 }
 
-// GetNetwork returns a *compute.Network representing the named network.
-func (g *GoogleComputeClient) GetNetwork(name string) (*compute.Network, error) {
-	networkGetCall := g.Service.Networks.Get(g.ProjectId, name)
-	network, err := networkGetCall.Do()
+// GetNetwork returns a *compute.Network representing the named network in
+// project, which is the host project when using Shared VPC.
+func (g *GoogleComputeClient) GetNetwork(project, name string) (*compute.Network, error) {
+	networkGetCall := g.Service.Networks.Get(project, name)
+	var network *compute.Network
+	err := g.retry("GetNetwork", true, func() (err error) {
+		network, err = networkGetCall.Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return network, nil
 }
 
+// GetSubnetwork returns a *compute.Subnetwork representing the named
+// subnetwork in the region of project.
+func (g *GoogleComputeClient) GetSubnetwork(project, region, name string) (*compute.Subnetwork, error) {
+	subnetworkGetCall := g.Service.Subnetworks.Get(project, region, name)
+	var subnetwork *compute.Subnetwork
+	err := g.retry("GetSubnetwork", true, func() (err error) {
+		subnetwork, err = subnetworkGetCall.Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subnetwork, nil
+}
+
 // CreateInstance creates an instance in Google Compute Engine based on the
 // supplied instanceConfig.
 func (g *GoogleComputeClient) CreateInstance(zone string, instanceConfig *InstanceConfig) (*compute.Operation, error) {
 	instance := &compute.Instance{
 		Description:       instanceConfig.Description,
-		Image:             instanceConfig.Image,
+		Disks:             instanceConfig.Disks,
+		Labels:            instanceConfig.Labels,
 		MachineType:       instanceConfig.MachineType,
 		Metadata:          instanceConfig.Metadata,
+		MinCpuPlatform:    instanceConfig.MinCpuPlatform,
 		Name:              instanceConfig.Name,
 		NetworkInterfaces: instanceConfig.NetworkInterfaces,
+		Scheduling:        instanceConfig.Scheduling,
 		ServiceAccounts:   instanceConfig.ServiceAccounts,
 		Tags:              instanceConfig.Tags,
 	}
 	instanceInsertCall := g.Service.Instances.Insert(g.ProjectId, zone, instance)
-	operation, err := instanceInsertCall.Do()
+	var operation *compute.Operation
+	err := g.retry("CreateInstance", false, func() (err error) {
+		operation, err = instanceInsertCall.Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -150,7 +328,11 @@ func (g *GoogleComputeClient) CreateInstance(zone string, instanceConfig *Instan
 // "STOPPED", "TERMINATED".
 func (g *GoogleComputeClient) InstanceStatus(zone, name string) (string, error) {
 	instanceGetCall := g.Service.Instances.Get(g.ProjectId, zone, name)
-	instance, err := instanceGetCall.Do()
+	var instance *compute.Instance
+	err := g.retry("InstanceStatus", true, func() (err error) {
+		instance, err = instanceGetCall.Do()
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -158,29 +340,70 @@ func (g *GoogleComputeClient) InstanceStatus(zone, name string) (string, error)
 }
 
 // CreateImage registers a GCE Image with a project.
-func (g *GoogleComputeClient) CreateImage(name, description, sourceURL string) (*compute.Operation, error) {
+func (g *GoogleComputeClient) CreateImage(name, description, sourceURL string, labels map[string]string) (*compute.Operation, error) {
 	imageRawDisk := &compute.ImageRawDisk{
 		ContainerType: "TAR",
 		Source:        sourceURL,
 	}
 	image := &compute.Image{
 		Description: description,
+		Labels:      labels,
 		Name:        name,
 		RawDisk:     imageRawDisk,
 		SourceType:  "RAW",
 	}
 	imageInsertCall := g.Service.Images.Insert(g.ProjectId, image)
-	operation, err := imageInsertCall.Do()
+	var operation *compute.Operation
+	err := g.retry("CreateImage", false, func() (err error) {
+		operation, err = imageInsertCall.Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return operation, nil
 }
 
-// GetNatIp returns the public IPv4 address for named GCE instance.
+// CreateImageFromDisk registers a GCE Image with a project using the named
+// persistent disk as the source.
+func (g *GoogleComputeClient) CreateImageFromDisk(name, description, sourceDisk string, labels map[string]string) (*compute.Operation, error) {
+	image := &compute.Image{
+		Description: description,
+		Labels:      labels,
+		Name:        name,
+		SourceDisk:  sourceDisk,
+		SourceType:  "RAW",
+	}
+	imageInsertCall := g.Service.Images.Insert(g.ProjectId, image)
+	var operation *compute.Operation
+	err := g.retry("CreateImageFromDisk", false, func() (err error) {
+		operation, err = imageInsertCall.Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// GetDisk returns a *compute.Disk representing the named persistent disk.
+func (g *GoogleComputeClient) GetDisk(zone, name string) (*compute.Disk, error) {
+	diskGetCall := g.Service.Disks.Get(g.ProjectId, zone, name)
+	var disk *compute.Disk
+	err := g.retry("GetDisk", true, func() (err error) {
+		disk, err = diskGetCall.Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disk, nil
+}
+
+// GetNatIP returns the public IPv4 address for named GCE instance. It is an
+// error if the instance has none.
 func (g *GoogleComputeClient) GetNatIP(zone, name string) (string, error) {
-	instanceGetCall := g.Service.Instances.Get(g.ProjectId, zone, name)
-	instance, err := instanceGetCall.Do()
+	instance, err := g.getInstance("GetNatIP", zone, name)
 	if err != nil {
 		return "", err
 	}
@@ -194,13 +417,46 @@ func (g *GoogleComputeClient) GetNatIP(zone, name string) (string, error) {
 			}
 		}
 	}
-	return "", nil
+	return "", fmt.Errorf("Instance %s has no external IP address", name)
+}
+
+// GetInternalIP returns the internal IPv4 address of the named instance.
+func (g *GoogleComputeClient) GetInternalIP(zone, name string) (string, error) {
+	instance, err := g.getInstance("GetInternalIP", zone, name)
+	if err != nil {
+		return "", err
+	}
+	for _, ni := range instance.NetworkInterfaces {
+		if ni.NetworkIP != "" {
+			return ni.NetworkIP, nil
+		}
+	}
+	return "", fmt.Errorf("Instance %s has no internal IP address", name)
+}
+
+// getInstance returns the named instance. method names the calling method
+// in retry logs.
+func (g *GoogleComputeClient) getInstance(method, zone, name string) (*compute.Instance, error) {
+	instanceGetCall := g.Service.Instances.Get(g.ProjectId, zone, name)
+	var instance *compute.Instance
+	err := g.retry(method, true, func() (err error) {
+		instance, err = instanceGetCall.Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
 }
 
 // ZoneOperationStatus returns the status for the named zone operation.
 func (g *GoogleComputeClient) ZoneOperationStatus(zone, name string) (string, error) {
 	zoneOperationsGetCall := g.Service.ZoneOperations.Get(g.ProjectId, zone, name)
-	operation, err := zoneOperationsGetCall.Do()
+	var operation *compute.Operation
+	err := g.retry("ZoneOperationStatus", true, func() (err error) {
+		operation, err = zoneOperationsGetCall.Do()
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -216,7 +472,11 @@ func (g *GoogleComputeClient) ZoneOperationStatus(zone, name string) (string, er
 // GlobalOperationStatus returns the status for the named global operation.
 func (g *GoogleComputeClient) GlobalOperationStatus(name string) (string, error) {
 	globalOperationsGetCall := g.Service.GlobalOperations.Get(g.ProjectId, name)
-	operation, err := globalOperationsGetCall.Do()
+	var operation *compute.Operation
+	err := g.retry("GlobalOperationStatus", true, func() (err error) {
+		operation, err = globalOperationsGetCall.Do()
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -229,14 +489,24 @@ func (g *GoogleComputeClient) GlobalOperationStatus(name string) (string, error)
 	return operation.Status, nil
 }
 
+// OperationError is the error of an operation that finished with errors.
+type OperationError struct {
+	Errors []*compute.OperationErrorErrors
+}
+
+// Error returns the messages of the operation's errors.
+func (e *OperationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Message)
+	}
+	return strings.Join(messages, "\n")
+}
+
 // processOperationStatus extracts errors from the specified operation.
 func processOperationStatus(o *compute.Operation) error {
 	if o.Error != nil {
-		messages := make([]string, len(o.Error.Errors))
-		for _, e := range o.Error.Errors {
-			messages = append(messages, e.Message)
-		}
-		return errors.New(strings.Join(messages, "\n"))
+		return &OperationError{Errors: o.Error.Errors}
 	}
 	return nil
 }
@@ -244,23 +514,141 @@ func processOperationStatus(o *compute.Operation) error {
 // DeleteImage deletes the named image. Returns a Global Operation.
 func (g *GoogleComputeClient) DeleteImage(name string) (*compute.Operation, error) {
 	imagesDeleteCall := g.Service.Images.Delete(g.ProjectId, name)
-	operation, err := imagesDeleteCall.Do()
+	var operation *compute.Operation
+	err := g.retry("DeleteImage", true, func() (err error) {
+		operation, err = imagesDeleteCall.Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return operation, nil
 }
 
+// ListInstances returns the instances in the zone.
+func (g *GoogleComputeClient) ListInstances(zone string) ([]*compute.Instance, error) {
+	var instances []*compute.Instance
+	pageToken := ""
+	for {
+		instancesListCall := g.Service.Instances.List(g.ProjectId, zone)
+		if pageToken != "" {
+			instancesListCall.PageToken(pageToken)
+		}
+		var instanceList *compute.InstanceList
+		err := g.retry("ListInstances", true, func() (err error) {
+			instanceList, err = instancesListCall.Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instanceList.Items...)
+		if instanceList.NextPageToken == "" {
+			return instances, nil
+		}
+		pageToken = instanceList.NextPageToken
+	}
+}
+
 // DeleteInstance deletes the named instance. Returns a Zone Operation.
 func (g *GoogleComputeClient) DeleteInstance(zone, name string) (*compute.Operation, error) {
 	instanceDeleteCall := g.Service.Instances.Delete(g.ProjectId, zone, name)
-	operation, err := instanceDeleteCall.Do()
+	var operation *compute.Operation
+	err := g.retry("DeleteInstance", true, func() (err error) {
+		operation, err = instanceDeleteCall.Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// ListDisks returns the persistent disks in the zone.
+func (g *GoogleComputeClient) ListDisks(zone string) ([]*compute.Disk, error) {
+	var disks []*compute.Disk
+	pageToken := ""
+	for {
+		disksListCall := g.Service.Disks.List(g.ProjectId, zone)
+		if pageToken != "" {
+			disksListCall.PageToken(pageToken)
+		}
+		var diskList *compute.DiskList
+		err := g.retry("ListDisks", true, func() (err error) {
+			diskList, err = disksListCall.Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, diskList.Items...)
+		if diskList.NextPageToken == "" {
+			return disks, nil
+		}
+		pageToken = diskList.NextPageToken
+	}
+}
+
+// DeleteDisk deletes the named persistent disk. Returns a Zone Operation.
+func (g *GoogleComputeClient) DeleteDisk(zone, name string) (*compute.Operation, error) {
+	diskDeleteCall := g.Service.Disks.Delete(g.ProjectId, zone, name)
+	var operation *compute.Operation
+	err := g.retry("DeleteDisk", true, func() (err error) {
+		operation, err = diskDeleteCall.Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return operation, nil
 }
 
+// newestImage returns the most recently created image that is not
+// deprecated, or nil.
+func newestImage(images []*compute.Image) *compute.Image {
+	var newest *compute.Image
+	var newestCreated time.Time
+	for _, image := range images {
+		if image.Deprecated != nil && image.Deprecated.State != "" && image.Deprecated.State != "ACTIVE" {
+			continue
+		}
+		created, _ := time.Parse(time.RFC3339, image.CreationTimestamp)
+		if newest == nil || created.After(newestCreated) {
+			newest, newestCreated = image, created
+		}
+	}
+	return newest
+}
+
+// zoneRegion returns the name of the region zone is in. The region is taken
+// from the zone's region URL when set, and otherwise derived from the zone
+// name, e.g. us-central1 for us-central1-a.
+func zoneRegion(zone *compute.Zone) string {
+	if zone.Region != "" {
+		return zone.Region[strings.LastIndex(zone.Region, "/")+1:]
+	}
+	if i := strings.LastIndex(zone.Name, "-"); i > 0 {
+		return zone.Name[:i]
+	}
+	return zone.Name
+}
+
+// NewBootDisk returns a *compute.AttachedDisk that creates the named
+// persistent boot disk from sourceImage along with the instance. When
+// autoDelete is false the disk outlives the instance.
+func NewBootDisk(name, sourceImage string, autoDelete bool) *compute.AttachedDisk {
+	return &compute.AttachedDisk{
+		AutoDelete: autoDelete,
+		Boot:       true,
+		InitializeParams: &compute.AttachedDiskInitializeParams{
+			DiskName:    name,
+			SourceImage: sourceImage,
+		},
+		Mode: "READ_WRITE",
+		Type: "PERSISTENT",
+	}
+}
+
 // NewNetworkInterface returns a *compute.NetworkInterface based on the data provided.
 func NewNetworkInterface(network *compute.Network, public bool) *compute.NetworkInterface {
 	accessConfigs := make([]*compute.AccessConfig, 0)
@@ -277,24 +665,39 @@ func NewNetworkInterface(network *compute.Network, public bool) *compute.Network
 	}
 }
 
-// NewServiceAccount returns a *compute.ServiceAccount with permissions required
-// for creating GCE machine images.
-func NewServiceAccount(email string) *compute.ServiceAccount {
+// NewPreemptibleScheduling returns a *compute.Scheduling for a preemptible
+// instance, which is terminated rather than restarted or migrated.
+func NewPreemptibleScheduling() *compute.Scheduling {
+	automaticRestart := false
+	return &compute.Scheduling{
+		AutomaticRestart:  &automaticRestart,
+		OnHostMaintenance: "TERMINATE",
+		Preemptible:       true,
+	}
+}
+
+// NewServiceAccount returns a *compute.ServiceAccount for the service account
+// with the given email, or the project's default compute service account if
+// email is "default", limited to scopes.
+func NewServiceAccount(email string, scopes []string) *compute.ServiceAccount {
 	return &compute.ServiceAccount{
-		Email: email,
-		Scopes: []string{
-			"https://www.googleapis.com/auth/userinfo.email",
-			"https://www.googleapis.com/auth/compute",
-			"https://www.googleapis.com/auth/devstorage.full_control",
-		},
+		Email:  email,
+		Scopes: scopes,
 	}
 }
 
-// MapToMetadata converts a map[string]string to a *compute.Metadata.
+// MapToMetadata converts a map[string]string to a *compute.Metadata. The
+// items are sorted by key.
 func MapToMetadata(metadata map[string]string) *compute.Metadata {
-	items := make([]*compute.MetadataItems, len(metadata))
-	for k, v := range metadata {
-		items = append(items, &compute.MetadataItems{k, v})
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]*compute.MetadataItems, 0, len(metadata))
+	for _, k := range keys {
+		value := metadata[k]
+		items = append(items, &compute.MetadataItems{Key: k, Value: &value})
 	}
 	return &compute.Metadata{
 		Items: items,
@@ -308,11 +711,10 @@ func SliceToTags(tags []string) *compute.Tags {
 	}
 }
 
-// scopes return a space separated list of scopes.
-func scopes() string {
-	s := []string{
+// scopes returns the OAuth scopes requested by the builder.
+func scopes() []string {
+	return []string{
 		"https://www.googleapis.com/auth/compute",
 		"https://www.googleapis.com/auth/devstorage.full_control",
 	}
-	return strings.Join(s, " ")
 }
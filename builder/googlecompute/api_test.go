@@ -0,0 +1,292 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/kelseyhightower/packer-builder-googlecompute/builder/googlecompute/testserver"
+	"google.golang.org/api/compute/v1"
+)
+
+// testClient returns a *GoogleComputeClient talking to server.
+func testClient(t *testing.T, server *testserver.Server) *GoogleComputeClient {
+	ts := &metadataTokenSource{endpoint: server.URL}
+	client, err := New(server.ProjectId, "us-central1-a", server.ComputeEndpoint(), ts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return client
+}
+
+// testLastRequest decodes the body of the last request made with method to
+// a path ending in suffix.
+func testLastRequest(t *testing.T, server *testserver.Server, method, suffix string) map[string]interface{} {
+	var body map[string]interface{}
+	for _, r := range server.Requests() {
+		if r.Method == method && strings.HasSuffix(r.Path, suffix) {
+			body = nil
+			if err := json.Unmarshal(r.Body, &body); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+	}
+	if body == nil {
+		t.Fatalf("no %s request to %s", method, suffix)
+	}
+	return body
+}
+
+func TestGoogleComputeClient_CreateInstance(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	client := testClient(t, server)
+
+	image, err := client.GetImage("debian-7-wheezy-v20131014")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	network, err := client.GetNetwork("hashicorp", "default")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	instanceConfig := &InstanceConfig{
+		Disks:             []*compute.AttachedDisk{NewBootDisk("packer", image.SelfLink, false)},
+		Name:              "packer",
+		NetworkInterfaces: []*compute.NetworkInterface{NewNetworkInterface(network, true)},
+	}
+	operation, err := client.CreateInstance("us-central1-a", instanceConfig)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status, err := client.ZoneOperationStatus("us-central1-a", operation.Name); err != nil || status != "DONE" {
+		t.Fatalf("bad operation: %s %v", status, err)
+	}
+
+	body := testLastRequest(t, server, "POST", "/zones/us-central1-a/instances")
+	if _, ok := body["image"]; ok {
+		t.Fatal("v1 instances must not set image")
+	}
+	disks := body["disks"].([]interface{})
+	disk := disks[0].(map[string]interface{})
+	params := disk["initializeParams"].(map[string]interface{})
+	if disk["boot"] != true || params["sourceImage"] != image.SelfLink || params["diskName"] != "packer" {
+		t.Fatalf("bad boot disk: %#v", disk)
+	}
+
+	if status, err := client.InstanceStatus("us-central1-a", "packer"); err != nil || status != "RUNNING" {
+		t.Fatalf("bad status: %s %v", status, err)
+	}
+	if ip, err := client.GetNatIP("us-central1-a", "packer"); err != nil || ip == "" {
+		t.Fatalf("bad nat ip: %s %v", ip, err)
+	}
+	if _, err := client.GetDisk("us-central1-a", "packer"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The boot disk is not auto-deleted, so it survives the instance.
+	if _, err := client.DeleteInstance("us-central1-a", "packer"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := client.InstanceStatus("us-central1-a", "packer"); err == nil {
+		t.Fatal("instance should be deleted")
+	}
+	if _, err := client.GetDisk("us-central1-a", "packer"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestGoogleComputeClient_CreateImage(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	client := testClient(t, server)
+
+	source := "https://storage.cloud.google.com/packer-images/packer.tar.gz"
+	operation, err := client.CreateImage("packer", "Created by Packer", source, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := client.GlobalOperationStatus(operation.Name); err == nil {
+		t.Fatal("operation should fail without the tarball")
+	}
+
+	server.PutObject("packer-images", "packer.tar.gz", []byte("tarball"))
+	labels := map[string]string{buildIdLabel: "build"}
+	operation, err = client.CreateImage("packer", "Created by Packer", source, labels)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status, err := client.GlobalOperationStatus(operation.Name); err != nil || status != "DONE" {
+		t.Fatalf("bad operation: %s %v", status, err)
+	}
+	body := testLastRequest(t, server, "POST", "/global/images")
+	rawDisk := body["rawDisk"].(map[string]interface{})
+	if body["sourceType"] != "RAW" || rawDisk["containerType"] != "TAR" || rawDisk["source"] != source {
+		t.Fatalf("bad image request: %#v", body)
+	}
+	if l, ok := body["labels"].(map[string]interface{}); !ok || l[buildIdLabel] != "build" {
+		t.Fatalf("bad image labels: %#v", body["labels"])
+	}
+	if _, err := client.DeleteImage("packer"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestGoogleComputeClient_GetImage(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	client := testClient(t, server)
+
+	if _, err := client.GetImage("debian-7-wheezy-v20131014"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, err := client.GetImage("missing")
+	if err == nil {
+		t.Fatal("should fail for a missing image")
+	}
+	for _, project := range append([]string{"hashicorp"}, defaultImageProjects...) {
+		if !strings.Contains(err.Error(), project) {
+			t.Fatalf("error should list project %s: %s", project, err)
+		}
+	}
+}
+
+func TestGoogleComputeClient_GetImage_projects(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	server.AddPublicImage("ubuntu-os-cloud", &compute.Image{Name: "ubuntu-1404-trusty-v20141031"})
+	server.AddPublicImage("shared-images", &compute.Image{Name: "base-v1"})
+	server.AddPublicImage("shared-images", &compute.Image{Name: "debian-7-wheezy-v20131014"})
+	client := testClient(t, server)
+
+	names := []string{
+		"ubuntu-1404-trusty-v20141031",
+		"projects/ubuntu-os-cloud/global/images/ubuntu-1404-trusty-v20141031",
+		server.ComputeEndpoint() + "ubuntu-os-cloud/global/images/ubuntu-1404-trusty-v20141031",
+	}
+	for _, name := range names {
+		image, err := client.GetImage(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !strings.HasSuffix(image.SelfLink, "/ubuntu-os-cloud/global/images/ubuntu-1404-trusty-v20141031") {
+			t.Fatalf("%s: bad image: %#v", name, image)
+		}
+	}
+	if _, err := client.GetImage("base-v1"); err == nil {
+		t.Fatal("shared-images should not be searched by default")
+	}
+	if _, err := client.GetImage("projects/shared-images/global/images/base-v1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	client.ImageProjects = []string{"shared-images", "ubuntu-os-cloud"}
+	if _, err := client.GetImage("base-v1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := client.GetImage("ubuntu-1404-trusty-v20141031"); err != nil {
+		t.Fatalf("the default projects should still be searched: %s", err)
+	}
+	image, err := client.GetImage("debian-7-wheezy-v20131014")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(image.SelfLink, "/shared-images/") {
+		t.Fatalf("source_image_project_id should be searched first: %s", image.SelfLink)
+	}
+	projects := client.imageProjects()
+	want := []string{"shared-images", "ubuntu-os-cloud", "hashicorp", "debian-cloud", "centos-cloud",
+		"coreos-cloud", "opensuse-cloud", "rhel-cloud", "suse-cloud"}
+	if strings.Join(projects, ",") != strings.Join(want, ",") {
+		t.Fatalf("bad image projects: %v", projects)
+	}
+}
+
+func TestParseImageURL(t *testing.T) {
+	cases := []struct {
+		url, collection string
+		project, name   string
+	}{
+		{"debian-7-wheezy-v20131014", "images", "", "debian-7-wheezy-v20131014"},
+		{"projects/debian-cloud/global/images/debian-7-wheezy-v20131014", "images", "debian-cloud", "debian-7-wheezy-v20131014"},
+		{"https://www.googleapis.com/compute/v1/projects/debian-cloud/global/images/debian-7-wheezy-v20131014", "images", "debian-cloud", "debian-7-wheezy-v20131014"},
+		{"projects/debian-cloud/global/images/family/debian-7", "images/family", "debian-cloud", "debian-7"},
+	}
+	for _, c := range cases {
+		project, name, err := parseImageURL(c.url, c.collection)
+		if err != nil {
+			t.Fatalf("%s: %s", c.url, err)
+		}
+		if project != c.project || name != c.name {
+			t.Fatalf("%s: got %q, %q", c.url, project, name)
+		}
+	}
+	invalid := []string{
+		"global/images/debian-7-wheezy-v20131014",
+		"projects/debian-cloud/global/networks/default",
+		"projects/debian-cloud/global/images/family/debian-7",
+	}
+	for _, url := range invalid {
+		if _, _, err := parseImageURL(url, "images"); err == nil {
+			t.Fatalf("%s should be invalid", url)
+		}
+	}
+}
+
+func TestGoogleComputeClient_GetImageFromFamily(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	server.AddImage(&compute.Image{
+		Name:              "debian-7-wheezy-v20131001",
+		Family:            "debian-7",
+		CreationTimestamp: "2013-10-01T12:00:00.000-07:00",
+	})
+	server.AddImage(&compute.Image{
+		Name:              "debian-7-wheezy-v20131101",
+		Family:            "debian-7",
+		CreationTimestamp: "2013-11-01T12:00:00.000-07:00",
+	})
+	server.AddImage(&compute.Image{
+		Name:              "debian-7-wheezy-v20131201",
+		Family:            "debian-7",
+		CreationTimestamp: "2013-12-01T12:00:00.000-07:00",
+		Deprecated:        &compute.DeprecationStatus{State: "DEPRECATED"},
+	})
+	client := testClient(t, server)
+
+	image, err := client.GetImageFromFamily("debian-7")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if image.Name != "debian-7-wheezy-v20131101" || image.SelfLink == "" {
+		t.Fatalf("expected the newest non-deprecated image, got: %#v", image)
+	}
+	if _, err := client.GetImageFromFamily("missing"); err == nil {
+		t.Fatal("should fail for a missing family")
+	}
+}
+
+func TestMapToMetadata(t *testing.T) {
+	metadata := MapToMetadata(map[string]string{"b": "2", "a": "1"})
+	if len(metadata.Items) != 2 {
+		t.Fatalf("bad items: %#v", metadata.Items)
+	}
+	if metadata.Items[0].Key != "a" || *metadata.Items[0].Value != "1" || metadata.Items[1].Key != "b" {
+		t.Fatalf("items should be sorted by key: %#v", metadata.Items)
+	}
+}
+
+func TestZoneRegion(t *testing.T) {
+	zone := &compute.Zone{Name: "us-central1-a"}
+	if region := zoneRegion(zone); region != "us-central1" {
+		t.Fatalf("bad region: %s", region)
+	}
+	zone.Region = "https://www.googleapis.com/compute/v1/projects/hashicorp/regions/europe-west1"
+	if region := zoneRegion(zone); region != "europe-west1" {
+		t.Fatalf("bad region: %s", region)
+	}
+}
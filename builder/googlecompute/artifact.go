@@ -11,8 +11,10 @@ import (
 
 // Artifact represents a GCE image as the result of a Packer build.
 type Artifact struct {
-	imageName string
-	client    *GoogleComputeClient
+	imageName   string
+	sourceImage string
+	zone        string
+	client      ComputeAPI
 }
 
 // BuilderId returns the builder Id.
@@ -43,5 +45,5 @@ func (a *Artifact) Id() string {
 
 // String returns the string representation of the artifact.
 func (a *Artifact) String() string {
-	return fmt.Sprintf("A disk image was created: %v", a.imageName)
+	return fmt.Sprintf("A disk image was created: %v (from %v in zone %v)", a.imageName, a.sourceImage, a.zone)
 }
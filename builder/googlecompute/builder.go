@@ -10,48 +10,117 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/common/uuid"
 	"github.com/mitchellh/packer/packer"
 )
 
 // The unique ID for this builder.
 const BuilderId = "kelseyhightower.googlecompute"
 
+// Image creation methods.
+const (
+	// imageMethodDisk creates the image directly from the instance's
+	// persistent boot disk.
+	imageMethodDisk = "disk"
+	// imageMethodTarball bundles the image on the instance with gcimagebundle
+	// and registers it from a tarball stored in Google Cloud Storage.
+	imageMethodTarball = "tarball"
+)
+
+// What happens to the build instance when a build fails.
+const (
+	// onErrorCleanup destroys the instance.
+	onErrorCleanup = "cleanup"
+	// onErrorKeep leaves the instance running for debugging.
+	onErrorKeep = "keep"
+)
+
+// defaultPreemptibleAttempts is the default number of times a build on a
+// preemptible instance is attempted.
+const defaultPreemptibleAttempts = 3
+
+// sshKeysMetadataKey is the instance metadata key holding the SSH key
+// generated by Packer.
+const sshKeysMetadataKey = "sshKeys"
+
+// scopePrefix is the common prefix of Google OAuth scopes.
+const scopePrefix = "https://www.googleapis.com/auth/"
+
+// tagPattern matches valid instance tags.
+var tagPattern = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
 // Builder represents a Packer Builder.
 type Builder struct {
 	config config
 	runner multistep.Runner
+	// mu guards runner and cancel, which is closed by Cancel.
+	mu     sync.Mutex
+	cancel chan struct{}
+	// connect replaces the step that connects to the instance over SSH. Tests
+	// use it to supply a fake communicator.
+	connect multistep.Step
 }
 
 // config holds the googlecompute builder configuration settings.
 type config struct {
-	BucketName          string            `mapstructure:"bucket_name"`
-	ClientSecretsFile   string            `mapstructure:"client_secrets_file"`
-	ImageName           string            `mapstructure:"image_name"`
-	ImageDescription    string            `mapstructure:"image_description"`
-	MachineType         string            `mapstructure:"machine_type"`
-	Metadata            map[string]string `mapstructure:"metadata"`
-	Network             string            `mapstructure:"network"`
-	Passphrase          string            `mapstructure:"passphrase"`
-	PrivateKeyFile      string            `mapstructure:"private_key_file"`
-	ProjectId           string            `mapstructure:"project_id"`
-	SourceImage         string            `mapstructure:"source_image"`
-	SSHUsername         string            `mapstructure:"ssh_username"`
-	SSHPort             uint              `mapstructure:"ssh_port"`
-	RawSSHTimeout       string            `mapstructure:"ssh_timeout"`
-	RawStateTimeout     string            `mapstructure:"state_timeout"`
-	Tags                []string          `mapstructure:"tags"`
-	Zone                string            `mapstructure:"zone"`
-	clientSecrets       *clientSecrets
-	common.PackerConfig `mapstructure:",squash"`
-	instanceName        string
-	privateKeyBytes     []byte
-	sshTimeout          time.Duration
-	stateTimeout        time.Duration
-	tpl                 *packer.ConfigTemplate
+	AccountFile                  string            `mapstructure:"account_file"`
+	APIMaxAttempts               int               `mapstructure:"api_max_attempts"`
+	RawAPIMaxBackoff             string            `mapstructure:"api_max_backoff"`
+	BucketName                   string            `mapstructure:"bucket_name"`
+	ClientSecretsFile            string            `mapstructure:"client_secrets_file"`
+	ComputeEndpoint              string            `mapstructure:"compute_endpoint"`
+	CustomCPUs                   int               `mapstructure:"custom_cpus"`
+	CustomMemoryMb               int64             `mapstructure:"custom_memory_mb"`
+	DisableDefaultServiceAccount bool              `mapstructure:"disable_default_service_account"`
+	DiskSizeGb                   int64             `mapstructure:"disk_size_gb"`
+	DiskType                     string            `mapstructure:"disk_type"`
+	FallbackZones                []string          `mapstructure:"fallback_zones"`
+	ImageName                    string            `mapstructure:"image_name"`
+	ImageDescription             string            `mapstructure:"image_description"`
+	ImageMethod                  string            `mapstructure:"image_method"`
+	LeakReportFile               string            `mapstructure:"leak_report_file"`
+	MachineType                  string            `mapstructure:"machine_type"`
+	Metadata                     map[string]string `mapstructure:"metadata"`
+	MetadataFiles                map[string]string `mapstructure:"metadata_files"`
+	MinCPUPlatform               string            `mapstructure:"min_cpu_platform"`
+	Network                      string            `mapstructure:"network"`
+	NetworkProjectId             string            `mapstructure:"network_project_id"`
+	OmitExternalIP               bool              `mapstructure:"omit_external_ip"`
+	OnError                      string            `mapstructure:"on_error"`
+	Passphrase                   string            `mapstructure:"passphrase"`
+	Preemptible                  bool              `mapstructure:"preemptible"`
+	PreemptibleAttempts          int               `mapstructure:"preemptible_attempts"`
+	PrivateKeyFile               string            `mapstructure:"private_key_file"`
+	ProjectId                    string            `mapstructure:"project_id"`
+	Scopes                       []string          `mapstructure:"scopes"`
+	ServiceAccountEmail          string            `mapstructure:"service_account_email"`
+	SourceImage                  string            `mapstructure:"source_image"`
+	SourceImageFamily            string            `mapstructure:"source_image_family"`
+	SourceImageProjects          []string          `mapstructure:"source_image_project_id"`
+	SSHPrivateKeyFile            string            `mapstructure:"ssh_private_key_file"`
+	SSHUsername                  string            `mapstructure:"ssh_username"`
+	SSHPort                      uint              `mapstructure:"ssh_port"`
+	RawSSHTimeout                string            `mapstructure:"ssh_timeout"`
+	StartupScriptFile            string            `mapstructure:"startup_script_file"`
+	RawStateTimeout              string            `mapstructure:"state_timeout"`
+	Subnetwork                   string            `mapstructure:"subnetwork"`
+	Tags                         []string          `mapstructure:"tags"`
+	UseInternalIP                bool              `mapstructure:"use_internal_ip"`
+	Zone                         string            `mapstructure:"zone"`
+	account                      *accountFile
+	apiMaxBackoff                time.Duration
+	common.PackerConfig          `mapstructure:",squash"`
+	instanceName                 string
+	sshTimeout                   time.Duration
+	stateTimeout                 time.Duration
+	tpl                          *packer.ConfigTemplate
 }
 
 // Prepare processes the build configuration parameters.
@@ -67,15 +136,25 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 	}
 	b.config.tpl.UserVars = b.config.PackerUserVars
 
+	var warnings []string
 	errs := common.CheckUnusedConfig(md)
 	// Collect errors if any.
 	if err := common.CheckUnusedConfig(md); err != nil {
 		return nil, err
 	}
 	// Set defaults.
-	if b.config.Network == "" {
+	if b.config.Network == "" && b.config.Subnetwork == "" {
 		b.config.Network = "default"
 	}
+	if b.config.APIMaxAttempts == 0 {
+		b.config.APIMaxAttempts = defaultMaxAttempts
+	}
+	if b.config.RawAPIMaxBackoff == "" {
+		b.config.RawAPIMaxBackoff = defaultMaxDelay.String()
+	}
+	if b.config.DiskType == "" {
+		b.config.DiskType = "pd-standard"
+	}
 	if b.config.ImageDescription == "" {
 		b.config.ImageDescription = "Created by Packer"
 	}
@@ -83,9 +162,27 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 		// Default to packer-{{ unix timestamp (utc) }}
 		b.config.ImageName = "packer-{{timestamp}}"
 	}
-	if b.config.MachineType == "" {
+	if b.config.ImageMethod == "" {
+		// Templates written before image_method existed upload the image
+		// to their bucket.
+		if b.config.BucketName != "" {
+			b.config.ImageMethod = imageMethodTarball
+		} else {
+			b.config.ImageMethod = imageMethodDisk
+		}
+	}
+	if b.config.LeakReportFile == "" {
+		b.config.LeakReportFile = defaultLeakReportFile
+	}
+	if b.config.MachineType == "" && b.config.CustomCPUs == 0 && b.config.CustomMemoryMb == 0 {
 		b.config.MachineType = "n1-standard-1"
 	}
+	if b.config.OnError == "" {
+		b.config.OnError = onErrorCleanup
+	}
+	if b.config.PreemptibleAttempts == 0 {
+		b.config.PreemptibleAttempts = defaultPreemptibleAttempts
+	}
 	if b.config.RawSSHTimeout == "" {
 		b.config.RawSSHTimeout = "5m"
 	}
@@ -100,20 +197,34 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 	}
 	// Process Templates
 	templates := map[string]*string{
-		"bucket_name":         &b.config.BucketName,
-		"client_secrets_file": &b.config.ClientSecretsFile,
-		"image_name":          &b.config.ImageName,
-		"image_description":   &b.config.ImageDescription,
-		"machine_type":        &b.config.MachineType,
-		"network":             &b.config.Network,
-		"passphrase":          &b.config.Passphrase,
-		"private_key_file":    &b.config.PrivateKeyFile,
-		"project_id":          &b.config.ProjectId,
-		"source_image":        &b.config.SourceImage,
-		"ssh_username":        &b.config.SSHUsername,
-		"ssh_timeout":         &b.config.RawSSHTimeout,
-		"state_timeout":       &b.config.RawStateTimeout,
-		"zone":                &b.config.Zone,
+		"account_file":          &b.config.AccountFile,
+		"api_max_backoff":       &b.config.RawAPIMaxBackoff,
+		"bucket_name":           &b.config.BucketName,
+		"client_secrets_file":   &b.config.ClientSecretsFile,
+		"compute_endpoint":      &b.config.ComputeEndpoint,
+		"disk_type":             &b.config.DiskType,
+		"image_name":            &b.config.ImageName,
+		"image_description":     &b.config.ImageDescription,
+		"image_method":          &b.config.ImageMethod,
+		"leak_report_file":      &b.config.LeakReportFile,
+		"machine_type":          &b.config.MachineType,
+		"min_cpu_platform":      &b.config.MinCPUPlatform,
+		"network":               &b.config.Network,
+		"network_project_id":    &b.config.NetworkProjectId,
+		"on_error":              &b.config.OnError,
+		"passphrase":            &b.config.Passphrase,
+		"private_key_file":      &b.config.PrivateKeyFile,
+		"project_id":            &b.config.ProjectId,
+		"service_account_email": &b.config.ServiceAccountEmail,
+		"source_image":          &b.config.SourceImage,
+		"source_image_family":   &b.config.SourceImageFamily,
+		"ssh_private_key_file":  &b.config.SSHPrivateKeyFile,
+		"ssh_username":          &b.config.SSHUsername,
+		"ssh_timeout":           &b.config.RawSSHTimeout,
+		"startup_script_file":   &b.config.StartupScriptFile,
+		"state_timeout":         &b.config.RawStateTimeout,
+		"subnetwork":            &b.config.Subnetwork,
+		"zone":                  &b.config.Zone,
 	}
 	for n, ptr := range templates {
 		var err error
@@ -123,32 +234,182 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 				errs, fmt.Errorf("Error processing %s: %s", n, err))
 		}
 	}
-	// Process required parameters.
-	if b.config.BucketName == "" {
-		errs = packer.MultiErrorAppend(
-			errs, errors.New("a bucket_name must be specified"))
+	metadata := make(map[string]string, len(b.config.Metadata))
+	for k, v := range b.config.Metadata {
+		key, err := b.config.tpl.Process(k, nil)
+		if err != nil {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Error processing metadata key %s: %s", k, err))
+			continue
+		}
+		metadata[key], err = b.config.tpl.Process(v, nil)
+		if err != nil {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Error processing metadata %s: %s", k, err))
+		}
 	}
-	if b.config.ClientSecretsFile == "" {
-		errs = packer.MultiErrorAppend(
-			errs, errors.New("a client_secrets_file must be specified"))
+	b.config.Metadata = metadata
+	if b.config.NetworkProjectId == "" {
+		b.config.NetworkProjectId = b.config.ProjectId
+	}
+	metadataFiles := make(map[string]string, len(b.config.MetadataFiles)+1)
+	for k, v := range b.config.MetadataFiles {
+		key, err := b.config.tpl.Process(k, nil)
+		if err != nil {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Error processing metadata_files key %s: %s", k, err))
+			continue
+		}
+		metadataFiles[key], err = b.config.tpl.Process(v, nil)
+		if err != nil {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Error processing metadata_files %s: %s", k, err))
+		}
+	}
+	if b.config.StartupScriptFile != "" {
+		if _, ok := metadataFiles[startupScriptMetadataKey]; ok {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("startup_script_file cannot be combined with %s in metadata_files", startupScriptMetadataKey))
+		}
+		metadataFiles[startupScriptMetadataKey] = b.config.StartupScriptFile
+	}
+	b.config.MetadataFiles = metadataFiles
+	for i, tag := range b.config.Tags {
+		var err error
+		b.config.Tags[i], err = b.config.tpl.Process(tag, nil)
+		if err != nil {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Error processing tag %s: %s", tag, err))
+		}
 	}
-	if b.config.PrivateKeyFile == "" {
+	// Process required parameters.
+	switch b.config.ImageMethod {
+	case imageMethodDisk:
+		if b.config.BucketName != "" {
+			warnings = append(warnings, "bucket_name is ignored when image_method is disk")
+		}
+	case imageMethodTarball:
+		if b.config.BucketName == "" {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("a bucket_name must be specified when image_method is tarball"))
+		}
+	default:
 		errs = packer.MultiErrorAppend(
-			errs, errors.New("a private_key_file must be specified"))
+			errs, fmt.Errorf("image_method must be %q or %q", imageMethodDisk, imageMethodTarball))
 	}
 	if b.config.ProjectId == "" {
 		errs = packer.MultiErrorAppend(
 			errs, errors.New("a project_id must be specified"))
 	}
-	if b.config.SourceImage == "" {
+	if b.config.SourceImage == "" && b.config.SourceImageFamily == "" {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("a source_image or source_image_family must be specified"))
+	}
+	if b.config.SourceImage != "" && b.config.SourceImageFamily != "" {
 		errs = packer.MultiErrorAppend(
-			errs, errors.New("a source_image must be specified"))
+			errs, errors.New("only one of source_image and source_image_family may be specified"))
 	}
 	if b.config.Zone == "" {
 		errs = packer.MultiErrorAppend(
 			errs, errors.New("a zone must be specified"))
 	}
+	seenZones := map[string]bool{b.config.Zone: true}
+	for _, zone := range b.config.FallbackZones {
+		if seenZones[zone] {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("fallback_zones: zone %q is listed more than once", zone))
+		}
+		seenZones[zone] = true
+	}
+	// Read the metadata files into the metadata.
+	if err := loadMetadataFiles(b.config.Metadata, b.config.MetadataFiles); err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+	if _, ok := b.config.Metadata[sshKeysMetadataKey]; ok {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("metadata cannot contain %s, which is set to the SSH key generated by Packer", sshKeysMetadataKey))
+	}
+	if err := checkMetadataSize(b.config.Metadata); err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+	for _, tag := range b.config.Tags {
+		if !tagPattern.MatchString(tag) {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("invalid tag %q: tags must be 1-63 lowercase letters, digits or dashes, starting with a letter and not ending with a dash", tag))
+		}
+	}
+	switch b.config.DiskType {
+	case "pd-standard", "pd-ssd", "pd-balanced":
+	default:
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("disk_type must be pd-standard, pd-ssd or pd-balanced, not %q", b.config.DiskType))
+	}
+	if b.config.DiskSizeGb < 0 {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("disk_size_gb must not be negative"))
+	}
+	// Process the service account settings. Scopes may be given without the
+	// https://www.googleapis.com/auth/ prefix.
+	for i, scope := range b.config.Scopes {
+		if !strings.Contains(scope, "/") {
+			b.config.Scopes[i] = scopePrefix + scope
+		}
+	}
+	if b.config.DisableDefaultServiceAccount {
+		if b.config.ServiceAccountEmail != "" || len(b.config.Scopes) > 0 {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("service_account_email and scopes cannot be combined with disable_default_service_account"))
+		}
+		if b.config.ImageMethod == imageMethodTarball {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("disable_default_service_account cannot be used when image_method is tarball, as the instance uploads the image to bucket_name"))
+		}
+	}
+	if b.config.ImageMethod == imageMethodTarball && len(b.config.Scopes) > 0 && !hasStorageWriteScope(b.config.Scopes) {
+		warnings = append(warnings, fmt.Sprintf(
+			"scopes does not include a Cloud Storage write scope such as %sdevstorage.read_write, so uploading the image to bucket_name will likely fail", scopePrefix))
+	}
+	if b.config.SSHPrivateKeyFile != "" {
+		if _, err := loadSSHPrivateKey(b.config.SSHPrivateKeyFile); err != nil {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Failed loading ssh_private_key_file: %s", err))
+		}
+	}
+	if b.config.OnError != onErrorCleanup && b.config.OnError != onErrorKeep {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("on_error must be %q or %q", onErrorCleanup, onErrorKeep))
+	}
+	if b.config.OmitExternalIP && !b.config.UseInternalIP {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("use_internal_ip must be true when omit_external_ip is true, as the instance has no external IP to connect to"))
+	}
+	if b.config.CustomCPUs != 0 || b.config.CustomMemoryMb != 0 {
+		if b.config.MachineType != "" {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("machine_type cannot be combined with custom_cpus and custom_memory_mb"))
+		}
+		if b.config.CustomCPUs == 0 || b.config.CustomMemoryMb == 0 {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("custom_cpus and custom_memory_mb must be specified together"))
+		} else if err := checkCustomMachineType(b.config.CustomCPUs, b.config.CustomMemoryMb); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+	if b.config.PreemptibleAttempts < 0 {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("preemptible_attempts must not be negative"))
+	}
+	if b.config.APIMaxAttempts < 0 {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("api_max_attempts must not be negative"))
+	}
 	// Process timeout settings.
+	apiMaxBackoff, err := time.ParseDuration(b.config.RawAPIMaxBackoff)
+	if err != nil {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("Failed parsing api_max_backoff: %s", err))
+	}
+	b.config.apiMaxBackoff = apiMaxBackoff
 	sshTimeout, err := time.ParseDuration(b.config.RawSSHTimeout)
 	if err != nil {
 		errs = packer.MultiErrorAppend(
@@ -161,69 +422,143 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 			errs, fmt.Errorf("Failed parsing state_timeout: %s", err))
 	}
 	b.config.stateTimeout = stateTimeout
-	// Load the client secrets file.
-	cs, err := loadClientSecrets(b.config.ClientSecretsFile)
-	if err != nil {
-		errs = packer.MultiErrorAppend(
-			errs, fmt.Errorf("Failed parsing client secrets file: %s", err))
-	}
-	b.config.clientSecrets = cs
-	// Load the private key.
-	b.config.privateKeyBytes, err = processPrivateKeyFile(b.config.PrivateKeyFile, b.config.Passphrase)
-	if err != nil {
-		errs = packer.MultiErrorAppend(
-			errs, fmt.Errorf("Failed loading private key file: %s", err))
+	// Load the service account credentials, either from a single account
+	// file or from the client secrets file and private key pair. Without
+	// either, Application Default Credentials are discovered in Run.
+	if b.config.AccountFile != "" {
+		if b.config.ClientSecretsFile != "" || b.config.PrivateKeyFile != "" {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("account_file cannot be combined with client_secrets_file or private_key_file"))
+		} else {
+			b.config.account, err = loadAccountFile(b.config.AccountFile)
+			if err != nil {
+				errs = packer.MultiErrorAppend(
+					errs, fmt.Errorf("Failed parsing account file: %s", err))
+			}
+		}
+	} else if b.config.ClientSecretsFile != "" || b.config.PrivateKeyFile != "" {
+		if b.config.ClientSecretsFile == "" {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("a client_secrets_file must be specified with private_key_file"))
+		}
+		if b.config.PrivateKeyFile == "" {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("a private_key_file must be specified with client_secrets_file"))
+		}
+		if b.config.ClientSecretsFile != "" && b.config.PrivateKeyFile != "" {
+			b.config.account, err = loadLegacyAccount(b.config.ClientSecretsFile, b.config.PrivateKeyFile, b.config.Passphrase)
+			if err != nil {
+				errs = packer.MultiErrorAppend(errs, err)
+			}
+		}
 	}
 	// Check for any errors.
 	if errs != nil && len(errs.Errors) > 0 {
-		return nil, errs
+		return warnings, errs
+	}
+	return warnings, nil
+}
+
+// hasStorageWriteScope reports whether scopes allow writing to Cloud
+// Storage.
+func hasStorageWriteScope(scopes []string) bool {
+	for _, scope := range scopes {
+		switch strings.TrimPrefix(scope, scopePrefix) {
+		case "devstorage.read_write", "devstorage.full_control", "cloud-platform":
+			return true
+		}
 	}
-	return nil, nil
+	return false
 }
 
 // Run executes a googlecompute Packer build and returns a packer.Artifact
 // representing a GCE machine image.
 func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
 	// Initialize the Google Compute Engine API.
-	client, err := New(b.config.ProjectId, b.config.Zone, b.config.clientSecrets, b.config.privateKeyBytes)
+	var ts tokenSource
+	if b.config.account != nil {
+		ts = &jwtTokenSource{account: b.config.account}
+	} else {
+		var err error
+		ts, err = defaultTokenSource()
+		if err != nil {
+			log.Println("Failed to find Google Compute Engine credentials.")
+			return nil, err
+		}
+	}
+	client, err := New(b.config.ProjectId, b.config.Zone, b.config.ComputeEndpoint, ts)
 	if err != nil {
 		log.Println("Failed to create the Google Compute Engine client.")
 		return nil, err
 	}
-	// Set up the state.
-	state := new(multistep.BasicStateBag)
-	state.Put("config", b.config)
-	state.Put("client", client)
-	state.Put("hook", hook)
-	state.Put("ui", ui)
-	// Build the steps.
-	steps := []multistep.Step{
-		new(stepCreateSSHKey),
-		new(stepCreateInstance),
-		new(stepInstanceInfo),
-		&common.StepConnectSSH{
-			SSHAddress:     sshAddress,
-			SSHConfig:      sshConfig,
-			SSHWaitTimeout: 5 * time.Minute,
-		},
-		new(common.StepProvision),
-		new(stepUpdateGsutil),
-		new(stepCreateImage),
-		new(stepUploadImage),
-		new(stepRegisterImage),
+	client.ImageProjects = b.config.SourceImageProjects
+	client.retries = &retryPolicy{
+		MaxAttempts:  b.config.APIMaxAttempts,
+		InitialDelay: defaultInitialDelay,
+		MaxDelay:     b.config.apiMaxBackoff,
+	}
+	// The steps' calls stop retrying once the build is cancelled, but the
+	// cleanups' calls go on so that the instance is still destroyed.
+	runClient := *client
+	runClient.cancel = b.cancelChannel()
+	return b.run(ui, hook, &runClient, client)
+}
+
+// run runs the build steps using client, and returns the image created.
+// The steps clean up using cleanupClient.
+func (b *Builder) run(ui packer.Ui, hook packer.Hook, client, cleanupClient ComputeAPI) (packer.Artifact, error) {
+	cancel := b.cancelChannel()
+	// Every attempt labels its resources with the same build ID.
+	buildId := uuid.TimeOrderedUUID()
+	// A build whose preemptible instance is preempted starts over with a
+	// new instance. Each attempt cleans up its own instance.
+	attempts := 1
+	if b.config.Preemptible {
+		attempts = b.config.PreemptibleAttempts
 	}
-	// Run the steps.
-	if b.config.PackerDebug {
-		b.runner = &multistep.DebugRunner{
-			Steps:   steps,
-			PauseFn: common.MultistepDebugFn(ui),
+	var state *multistep.BasicStateBag
+	for attempt := 1; ; attempt++ {
+		// Set up the state.
+		state = new(multistep.BasicStateBag)
+		state.Put("build_id", buildId)
+		state.Put("cancel", cancel)
+		state.Put("cleanup_client", cleanupClient)
+		state.Put("config", b.config)
+		state.Put("client", client)
+		state.Put("hook", hook)
+		state.Put("ui", ui)
+		// Build the steps.
+		steps := b.steps()
+		// Run the steps, unless the build was cancelled before they started.
+		var runner multistep.Runner
+		if b.config.PackerDebug {
+			runner = &multistep.DebugRunner{
+				Steps:   steps,
+				PauseFn: common.MultistepDebugFn(ui),
+			}
+		} else {
+			runner = &multistep.BasicRunner{Steps: steps}
 		}
-	} else {
-		b.runner = &multistep.BasicRunner{Steps: steps}
+		if !b.setRunner(runner) {
+			break
+		}
+		runner.Run(state)
+		if _, ok := state.GetOk("instance_preempted"); !ok || attempt >= attempts {
+			break
+		}
+		if b.cancelled() {
+			break
+		}
+		ui.Say(fmt.Sprintf("Starting over with a new instance (attempt %d of %d)...", attempt+1, attempts))
 	}
-	b.runner.Run(state)
 	// Report any errors.
+	if b.cancelled() {
+		return nil, errCancelled
+	}
 	if rawErr, ok := state.GetOk("error"); ok {
+		if _, ok := state.GetOk("instance_preempted"); ok {
+			return nil, fmt.Errorf("%s (the instance was preempted %d times)", rawErr, attempts)
+		}
 		return nil, rawErr.(error)
 	}
 	if _, ok := state.GetOk("image_name"); !ok {
@@ -231,11 +566,101 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 		return nil, nil
 	}
 	artifact := &Artifact{
-		imageName: state.Get("image_name").(string),
-		client:    client,
+		imageName:   state.Get("image_name").(string),
+		sourceImage: state.Get("source_image").(string),
+		zone:        state.Get("zone").(string),
+		client:      client,
 	}
 	return artifact, nil
 }
 
-// Cancel.
-func (b *Builder) Cancel() {}
+// steps returns the build steps for the configured image method.
+func (b *Builder) steps() []multistep.Step {
+	connect := b.connect
+	if connect == nil {
+		connect = &common.StepConnectSSH{
+			SSHAddress:     sshAddress,
+			SSHConfig:      sshConfig,
+			SSHWaitTimeout: 5 * time.Minute,
+		}
+	}
+	steps := []multistep.Step{
+		new(stepCreateSSHKey),
+		new(stepCreateInstance),
+		new(stepInstanceInfo),
+		connect,
+		new(common.StepProvision),
+	}
+	switch b.config.ImageMethod {
+	case imageMethodDisk:
+		steps = append(steps,
+			new(stepTeardownInstance),
+			new(stepCreateDiskImage),
+		)
+	case imageMethodTarball:
+		steps = append(steps,
+			new(stepUpdateGsutil),
+			new(stepCreateImage),
+			new(stepUploadImage),
+			new(stepRegisterImage),
+		)
+	}
+	return steps
+}
+
+// setRunner makes runner the one cancelled by Cancel. It returns false if
+// the build was already cancelled.
+func (b *Builder) setRunner(runner multistep.Runner) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.cancel:
+		return false
+	default:
+	}
+	b.runner = runner
+	return true
+}
+
+// cancelChannel returns the channel closed when the build is cancelled,
+// creating it on first use.
+func (b *Builder) cancelChannel() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel == nil {
+		b.cancel = make(chan struct{})
+	}
+	return b.cancel
+}
+
+// cancelled reports whether the build was cancelled.
+func (b *Builder) cancelled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Cancel stops the build. Waits for GCE operations and remote commands are
+// aborted, and Cancel returns once the steps have cleaned up after
+// themselves, destroying the instance.
+func (b *Builder) Cancel() {
+	b.mu.Lock()
+	if b.cancel != nil {
+		select {
+		case <-b.cancel:
+		default:
+			close(b.cancel)
+		}
+	}
+	runner := b.runner
+	b.mu.Unlock()
+	if runner != nil {
+		log.Println("Cancelling the step runner...")
+		runner.Cancel()
+	}
+}
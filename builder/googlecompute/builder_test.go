@@ -3,3 +3,891 @@
 // that can be found in the LICENSE file.
 
 package googlecompute
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/packer-builder-googlecompute/builder/googlecompute/testserver"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	"google.golang.org/api/compute/v1"
+)
+
+func testConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"project_id":   "hashicorp",
+		"source_image": "debian-7-wheezy-v20131014",
+		"zone":         "us-central1-a",
+	}
+}
+
+// testBuilder returns a prepared *Builder for raw.
+func testBuilder(t *testing.T, raw map[string]interface{}) *Builder {
+	b := new(Builder)
+	if _, err := b.Prepare(raw); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return b
+}
+
+// testState returns a state bag wired to the fake API.
+func testState(t *testing.T, b *Builder, client ComputeAPI) multistep.StateBag {
+	state := new(multistep.BasicStateBag)
+	state.Put("build_id", "test-build")
+	state.Put("config", b.config)
+	state.Put("client", client)
+	state.Put("hook", &packer.DispatchHook{})
+	state.Put("ui", &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	})
+	return state
+}
+
+// stepTestCommunicator stands in for common.StepConnectSSH.
+type stepTestCommunicator struct {
+	comm packer.Communicator
+}
+
+func (s *stepTestCommunicator) Run(state multistep.StateBag) multistep.StepAction {
+	state.Put("communicator", s.comm)
+	return multistep.ActionContinue
+}
+
+func (s *stepTestCommunicator) Cleanup(state multistep.StateBag) {}
+
+// stepTestPreempt stands in for common.StepConnectSSH, preempting the
+// instance and failing the first preemptions times it is run.
+type stepTestPreempt struct {
+	server      *testserver.Server
+	preemptions int
+	runs        int
+}
+
+func (s *stepTestPreempt) Run(state multistep.StateBag) multistep.StepAction {
+	s.runs++
+	if s.runs > s.preemptions {
+		state.Put("communicator", new(packer.MockCommunicator))
+		return multistep.ActionContinue
+	}
+	s.server.Preempt(state.Get("instance_name").(string))
+	state.Put("error", errors.New("Timeout waiting for SSH."))
+	return multistep.ActionHalt
+}
+
+func (s *stepTestPreempt) Cleanup(state multistep.StateBag) {}
+
+// testSteps returns the builder's steps with SSH replaced by comm.
+func testSteps(b *Builder, comm packer.Communicator) []multistep.Step {
+	b.connect = &stepTestCommunicator{comm: comm}
+	return b.steps()
+}
+
+func TestBuilder_ImplementsBuilder(t *testing.T) {
+	var raw interface{}
+	raw = &Builder{}
+	if _, ok := raw.(packer.Builder); !ok {
+		t.Fatalf("Builder should be a builder")
+	}
+}
+
+func TestBuilderPrepare_ImageMethod(t *testing.T) {
+	b := testBuilder(t, testConfig())
+	if b.config.ImageMethod != imageMethodDisk {
+		t.Fatalf("bad image_method: %s", b.config.ImageMethod)
+	}
+
+	// Templates with a bucket keep uploading tarballs to it.
+	raw := testConfig()
+	raw["bucket_name"] = "packer-images"
+	b = testBuilder(t, raw)
+	if b.config.ImageMethod != imageMethodTarball {
+		t.Fatalf("image_method should default to tarball with bucket_name, got %s", b.config.ImageMethod)
+	}
+
+	raw["image_method"] = imageMethodDisk
+	warnings, err := new(Builder).Prepare(raw)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "bucket_name is ignored") {
+		t.Fatalf("expected a warning about bucket_name, got: %v", warnings)
+	}
+
+	raw = testConfig()
+	raw["image_method"] = imageMethodTarball
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("tarball should require bucket_name")
+	}
+	raw["bucket_name"] = "packer-images"
+	testBuilder(t, raw)
+
+	raw["image_method"] = "bogus"
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject unknown image_method")
+	}
+}
+
+func TestBuilderPrepare_APIRetries(t *testing.T) {
+	b := testBuilder(t, testConfig())
+	if b.config.APIMaxAttempts != defaultMaxAttempts {
+		t.Fatalf("bad api_max_attempts: %d", b.config.APIMaxAttempts)
+	}
+	if b.config.apiMaxBackoff != defaultMaxDelay {
+		t.Fatalf("bad api_max_backoff: %s", b.config.apiMaxBackoff)
+	}
+
+	raw := testConfig()
+	raw["api_max_attempts"] = 1
+	raw["api_max_backoff"] = "5s"
+	b = testBuilder(t, raw)
+	if b.config.APIMaxAttempts != 1 || b.config.apiMaxBackoff != 5*time.Second {
+		t.Fatalf("bad retry settings: %d, %s", b.config.APIMaxAttempts, b.config.apiMaxBackoff)
+	}
+
+	raw["api_max_backoff"] = "bogus"
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject bad api_max_backoff")
+	}
+	raw["api_max_backoff"] = "5s"
+	raw["api_max_attempts"] = -1
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject negative api_max_attempts")
+	}
+}
+
+func TestBuilderPrepare_SourceImage(t *testing.T) {
+	raw := testConfig()
+	raw["source_image_family"] = "debian-7"
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("source_image and source_image_family should be exclusive")
+	}
+	delete(raw, "source_image")
+	raw["source_image_project_id"] = []string{"debian-cloud", "shared-images"}
+	b := testBuilder(t, raw)
+	if b.config.SourceImageFamily != "debian-7" {
+		t.Fatalf("bad source_image_family: %s", b.config.SourceImageFamily)
+	}
+	if len(b.config.SourceImageProjects) != 2 || b.config.SourceImageProjects[1] != "shared-images" {
+		t.Fatalf("bad source_image_project_id: %v", b.config.SourceImageProjects)
+	}
+	delete(raw, "source_image_family")
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("a source image should be required")
+	}
+}
+
+func TestBuilderPrepare_MetadataAndTags(t *testing.T) {
+	raw := testConfig()
+	raw["metadata"] = map[string]string{"build-{{timestamp}}": "started-{{timestamp}}"}
+	raw["tags"] = []string{"packer", "build-{{timestamp}}"}
+	b := testBuilder(t, raw)
+	timestamp := strconv.FormatInt(packer.InitTime.Unix(), 10)
+	if b.config.Metadata["build-"+timestamp] != "started-"+timestamp {
+		t.Fatalf("metadata was not processed: %v", b.config.Metadata)
+	}
+	if b.config.Tags[1] != "build-"+timestamp {
+		t.Fatalf("tags were not processed: %v", b.config.Tags)
+	}
+
+	raw["metadata"] = map[string]string{"sshKeys": "root:ssh-rsa AAAA"}
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject metadata colliding with the ssh key")
+	}
+	raw["metadata"] = map[string]string{}
+	raw["tags"] = []string{"Not_A_Tag"}
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject invalid tags")
+	}
+}
+
+func TestBuilderPrepare_MetadataFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	userData := filepath.Join(dir, "user-data")
+	startupScript := filepath.Join(dir, "startup.sh")
+	if err := ioutil.WriteFile(userData, []byte("#cloud-config"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(startupScript, []byte("#!/bin/sh"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	raw := testConfig()
+	raw["metadata"] = map[string]string{"role": "web"}
+	raw["metadata_files"] = map[string]string{"user-data": userData}
+	raw["startup_script_file"] = startupScript
+	b := testBuilder(t, raw)
+	metadata := b.config.Metadata
+	if len(metadata) != 3 || metadata["role"] != "web" || metadata["user-data"] != "#cloud-config" || metadata["startup-script"] != "#!/bin/sh" {
+		t.Fatalf("bad metadata: %v", metadata)
+	}
+
+	raw["metadata_files"] = map[string]string{"user-data-{{timestamp}}": userData}
+	b = testBuilder(t, raw)
+	timestamp := strconv.FormatInt(packer.InitTime.Unix(), 10)
+	if b.config.Metadata["user-data-"+timestamp] != "#cloud-config" {
+		t.Fatalf("metadata_files keys were not processed: %v", b.config.Metadata)
+	}
+
+	raw["metadata_files"] = map[string]string{"user-data": userData}
+	raw["metadata"] = map[string]string{"user-data": "inline"}
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject keys set by both metadata and metadata_files")
+	}
+	raw["metadata"] = map[string]string{}
+	raw["metadata_files"] = map[string]string{"startup-script": userData}
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject startup-script in metadata_files with startup_script_file")
+	}
+	raw["metadata_files"] = map[string]string{"user-data": filepath.Join(dir, "missing")}
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject missing metadata files")
+	}
+
+	large := filepath.Join(dir, "large")
+	if err := ioutil.WriteFile(large, make([]byte, maxMetadataValueSize+1), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw["metadata_files"] = map[string]string{"user-data": large}
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject metadata values over the size limit")
+	}
+}
+
+func TestCheckMetadataSize(t *testing.T) {
+	value := strings.Repeat("x", maxMetadataValueSize)
+	if err := checkMetadataSize(map[string]string{"a": value}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := checkMetadataSize(map[string]string{"a": value, "b": value}); err == nil {
+		t.Fatal("should reject metadata over the total size limit")
+	}
+}
+
+func TestBuilderPrepare_CustomMachineType(t *testing.T) {
+	raw := testConfig()
+	raw["custom_cpus"] = 16
+	raw["custom_memory_mb"] = 14848
+	raw["min_cpu_platform"] = "Intel Skylake"
+	b := testBuilder(t, raw)
+	if b.config.MachineType != "" || b.config.MinCPUPlatform != "Intel Skylake" {
+		t.Fatalf("bad config: %#v", b.config)
+	}
+	raw["machine_type"] = "n1-standard-16"
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("machine_type should be exclusive with custom_cpus")
+	}
+	delete(raw, "machine_type")
+	delete(raw, "custom_memory_mb")
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("custom_cpus should require custom_memory_mb")
+	}
+	raw["custom_memory_mb"] = 4096
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject too little memory per vCPU")
+	}
+}
+
+func TestCheckCustomMachineType(t *testing.T) {
+	cases := []struct {
+		cpus     int
+		memoryMb int64
+		ok       bool
+	}{
+		{1, 1024, true},
+		{1, 6656, true},
+		{1, 768, false},
+		{1, 6912, false},
+		{2, 2048, true},
+		{3, 4096, false},
+		{16, 14848, true},
+		{16, 14592, false},
+		{16, 15000, false},
+		{96, 624 * 1024, true},
+		{98, 98 * 1024, false},
+		{0, 1024, false},
+	}
+	for _, c := range cases {
+		err := checkCustomMachineType(c.cpus, c.memoryMb)
+		if (err == nil) != c.ok {
+			t.Errorf("checkCustomMachineType(%d, %d) = %v, want ok %v", c.cpus, c.memoryMb, err, c.ok)
+		}
+	}
+}
+
+func TestBuilderPrepare_OnError(t *testing.T) {
+	b := testBuilder(t, testConfig())
+	if b.config.OnError != onErrorCleanup {
+		t.Fatalf("bad on_error default: %s", b.config.OnError)
+	}
+	raw := testConfig()
+	raw["on_error"] = "abort"
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject unknown on_error")
+	}
+}
+
+func TestBuilderPrepare_SSHPrivateKeyFile(t *testing.T) {
+	defer testChdir(t)()
+
+	raw := testConfig()
+	raw["ssh_private_key_file"] = "missing"
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject a missing key file")
+	}
+	if err := ioutil.WriteFile("bad", []byte("not a key"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw["ssh_private_key_file"] = "bad"
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject a bad key file")
+	}
+	raw["ssh_private_key_file"] = testSSHKeyFile(t)
+	testBuilder(t, raw)
+}
+
+func TestBuilderPrepare_AccountFile(t *testing.T) {
+	accountPath := writeTempJSON(t, testAccountFile())
+	defer os.Remove(accountPath)
+	raw := testConfig()
+	raw["account_file"] = accountPath
+	b := testBuilder(t, raw)
+	if b.config.account == nil || b.config.account.ClientEmail != "packer@developer.gserviceaccount.com" {
+		t.Fatalf("bad account: %#v", b.config.account)
+	}
+
+	badPath := writeTempKey(t, []byte("{"))
+	defer os.Remove(badPath)
+	raw["account_file"] = badPath
+	_, err := new(Builder).Prepare(raw)
+	if err == nil || !strings.Contains(err.Error(), "is not valid JSON") {
+		t.Fatalf("expected a JSON error, got: %v", err)
+	}
+}
+
+func TestBuilderPrepare_LegacyAccount(t *testing.T) {
+	accountPath := writeTempJSON(t, testAccountFile())
+	defer os.Remove(accountPath)
+	secretsPath := writeTempJSON(t, map[string]interface{}{
+		"web": map[string]string{"client_email": "legacy@developer.gserviceaccount.com"},
+	})
+	defer os.Remove(secretsPath)
+	keyPath := writeTempKey(t, []byte(testPKCS8Key))
+	defer os.Remove(keyPath)
+
+	raw := testConfig()
+	raw["client_secrets_file"] = secretsPath
+	raw["private_key_file"] = keyPath
+	b := testBuilder(t, raw)
+	if b.config.account == nil || b.config.account.ClientEmail != "legacy@developer.gserviceaccount.com" {
+		t.Fatalf("bad account: %#v", b.config.account)
+	}
+
+	legacy := map[string]string{
+		"client_secrets_file": secretsPath,
+		"private_key_file":    keyPath,
+	}
+	for key, path := range legacy {
+		raw := testConfig()
+		raw["account_file"] = accountPath
+		raw[key] = path
+		if _, err := new(Builder).Prepare(raw); err == nil {
+			t.Fatalf("account_file should be rejected with %s", key)
+		}
+	}
+	raw = testConfig()
+	raw["private_key_file"] = keyPath
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("private_key_file should require client_secrets_file")
+	}
+}
+
+func TestBuilderPrepare_OmitExternalIP(t *testing.T) {
+	raw := testConfig()
+	raw["omit_external_ip"] = true
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("omit_external_ip should require use_internal_ip")
+	}
+	raw["use_internal_ip"] = true
+	testBuilder(t, raw)
+}
+
+func TestBuilderPrepare_Disk(t *testing.T) {
+	b := testBuilder(t, testConfig())
+	if b.config.DiskType != "pd-standard" || b.config.DiskSizeGb != 0 {
+		t.Fatalf("bad disk defaults: %s %d", b.config.DiskType, b.config.DiskSizeGb)
+	}
+	raw := testConfig()
+	raw["disk_type"] = "local-ssd"
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject unknown disk_type")
+	}
+	raw["disk_type"] = "pd-balanced"
+	raw["disk_size_gb"] = -1
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject negative disk_size_gb")
+	}
+}
+
+func TestBuilderPrepare_ServiceAccount(t *testing.T) {
+	raw := testConfig()
+	raw["service_account_email"] = "builder@hashicorp.iam.gserviceaccount.com"
+	raw["scopes"] = []string{"cloud-platform", "https://www.googleapis.com/auth/compute.readonly"}
+	b := testBuilder(t, raw)
+	if b.config.Scopes[0] != "https://www.googleapis.com/auth/cloud-platform" || b.config.Scopes[1] != "https://www.googleapis.com/auth/compute.readonly" {
+		t.Fatalf("bad scopes: %v", b.config.Scopes)
+	}
+
+	raw["disable_default_service_account"] = true
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("disable_default_service_account should be exclusive with service_account_email")
+	}
+
+	raw = testConfig()
+	raw["image_method"] = imageMethodTarball
+	raw["bucket_name"] = "packer-images"
+	raw["scopes"] = []string{"devstorage.read_only"}
+	warnings, err := new(Builder).Prepare(raw)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "Cloud Storage write scope") {
+		t.Fatalf("expected a warning about storage scopes, got: %v", warnings)
+	}
+	raw["scopes"] = []string{"devstorage.read_write"}
+	if warnings, _ := new(Builder).Prepare(raw); len(warnings) != 0 {
+		t.Fatalf("bad warnings: %v", warnings)
+	}
+	delete(raw, "scopes")
+	raw["disable_default_service_account"] = true
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("tarball should require a service account")
+	}
+}
+
+func TestBuilderPrepare_FallbackZones(t *testing.T) {
+	raw := testConfig()
+	raw["fallback_zones"] = []string{"us-central1-b", "us-central1-c"}
+	testBuilder(t, raw)
+	raw["fallback_zones"] = []string{"us-central1-b", raw["zone"].(string)}
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject the primary zone as a fallback zone")
+	}
+	raw["fallback_zones"] = []string{"us-central1-b", "us-central1-b"}
+	if _, err := new(Builder).Prepare(raw); err == nil {
+		t.Fatal("should reject duplicate fallback zones")
+	}
+}
+
+func TestBuilderSteps_disk(t *testing.T) {
+	b := testBuilder(t, testConfig())
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, b, client)
+	runner := &multistep.BasicRunner{Steps: testSteps(b, new(packer.MockCommunicator))}
+	runner.Run(state)
+
+	if err, ok := state.GetOk("error"); ok {
+		t.Fatalf("err: %s", err)
+	}
+	image, ok := client.Images[b.config.ImageName]
+	if !ok {
+		t.Fatalf("image %s was not created", b.config.ImageName)
+	}
+	if image.SourceDisk == "" || image.RawDisk != nil {
+		t.Fatalf("image should be created from a disk: %#v", image)
+	}
+	if len(client.Instances) != 0 || len(client.Disks) != 0 {
+		t.Fatalf("resources left behind: %v %v", client.Instances, client.Disks)
+	}
+}
+
+func TestBuilderSteps_tarball(t *testing.T) {
+	raw := testConfig()
+	raw["image_method"] = imageMethodTarball
+	raw["bucket_name"] = "packer-images"
+	b := testBuilder(t, raw)
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, b, client)
+	comm := new(packer.MockCommunicator)
+	runner := &multistep.BasicRunner{Steps: testSteps(b, comm)}
+	runner.Run(state)
+
+	if err, ok := state.GetOk("error"); ok {
+		t.Fatalf("err: %s", err)
+	}
+	image, ok := client.Images[b.config.ImageName]
+	if !ok {
+		t.Fatalf("image %s was not created", b.config.ImageName)
+	}
+	source := "https://storage.cloud.google.com/packer-images/" + b.config.ImageName + ".tar.gz"
+	if image.RawDisk == nil || image.RawDisk.Source != source {
+		t.Fatalf("bad raw disk: %#v", image.RawDisk)
+	}
+	if !comm.StartCalled {
+		t.Fatal("image should be bundled on the instance")
+	}
+	if len(client.Instances) != 0 {
+		t.Fatalf("instances left behind: %v", client.Instances)
+	}
+}
+
+func TestBuilderSteps_imageFailure(t *testing.T) {
+	b := testBuilder(t, testConfig())
+	client := NewFakeComputeAPI("hashicorp")
+	client.OperationErrors["CreateImageFromDisk"] = errTest
+	state := testState(t, b, client)
+	runner := &multistep.BasicRunner{Steps: testSteps(b, new(packer.MockCommunicator))}
+	runner.Run(state)
+
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("build should fail")
+	}
+	if _, ok := client.Images[b.config.ImageName]; ok {
+		t.Fatal("image should not be created")
+	}
+	if len(client.Instances) != 0 || len(client.Disks) != 0 {
+		t.Fatalf("resources left behind: %v %v", client.Instances, client.Disks)
+	}
+}
+
+// testCancelCommunicator calls cancel when a command is started, and never
+// finishes the command.
+type testCancelCommunicator struct {
+	packer.MockCommunicator
+	cancel func()
+}
+
+func (c *testCancelCommunicator) Start(cmd *packer.RemoteCmd) error {
+	c.cancel()
+	return nil
+}
+
+func TestBuilderCancel(t *testing.T) {
+	cases := []struct {
+		method      string
+		imageMethod string
+	}{
+		{"GetImage", imageMethodDisk},
+		{"CreateInstance", imageMethodDisk},
+		{"InstanceStatus", imageMethodDisk},
+		{"DeleteInstance", imageMethodDisk},
+		{"CreateImageFromDisk", imageMethodDisk},
+		// Cancelled by the communicator while gsutil is updated.
+		{"", imageMethodTarball},
+	}
+	for _, c := range cases {
+		raw := testConfig()
+		raw["image_method"] = c.imageMethod
+		raw["bucket_name"] = "packer-images"
+		b := testBuilder(t, raw)
+		// Cancel returns once the steps are cleaned up, so only wait for the
+		// build to be marked cancelled.
+		var once sync.Once
+		cancel := func() {
+			once.Do(func() {
+				b.mu.Lock()
+				cancelled := b.cancel
+				b.mu.Unlock()
+				go b.Cancel()
+				<-cancelled
+			})
+		}
+		client := NewFakeComputeAPI("hashicorp")
+		client.OnCall = func(method string) {
+			if method == c.method {
+				cancel()
+			}
+		}
+		b.connect = &stepTestCommunicator{comm: &testCancelCommunicator{cancel: cancel}}
+		ui := &packer.BasicUi{
+			Reader: new(bytes.Buffer),
+			Writer: ioutil.Discard,
+		}
+		if _, err := b.run(ui, &packer.DispatchHook{}, client, client); err != errCancelled {
+			t.Errorf("%s %s: expected the build to be cancelled, got: %v", c.imageMethod, c.method, err)
+		}
+		if len(client.Instances) != 0 || len(client.Disks) != 0 {
+			t.Errorf("%s %s: resources left behind: %v %v", c.imageMethod, c.method, client.Instances, client.Disks)
+		}
+	}
+}
+
+// stepTestCancel stands in for common.StepConnectSSH, cancelling the build
+// and making the server's next requests fail with transient errors.
+type stepTestCancel struct {
+	b      *Builder
+	server *testserver.Server
+}
+
+func (s *stepTestCancel) Run(state multistep.StateBag) multistep.StepAction {
+	go s.b.Cancel()
+	<-s.b.cancelChannel()
+	s.server.FailNext("DELETE", 2)
+	s.server.FailNext("GET", 2)
+	return multistep.ActionHalt
+}
+
+func (s *stepTestCancel) Cleanup(state multistep.StateBag) {}
+
+func TestBuilderCancel_cleanupRetries(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer setCredentialsEnv(t, "", dir, server.MetadataHost())()
+
+	raw := testConfig()
+	raw["api_max_backoff"] = "10ms"
+	raw["compute_endpoint"] = server.ComputeEndpoint()
+	b := testBuilder(t, raw)
+	b.connect = &stepTestCancel{b: b, server: server}
+	ui := &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: ioutil.Discard,
+	}
+	if _, err := b.Run(ui, &packer.DispatchHook{}, nil); err != errCancelled {
+		t.Fatalf("expected the build to be cancelled, got: %v", err)
+	}
+	if len(server.Instances()) != 0 || len(server.Disks()) != 0 {
+		t.Fatalf("resources left behind: %v %v", server.Instances(), server.Disks())
+	}
+}
+
+// testGsutilCommunicator simulates a guest whose `gsutil cp` uploads to the
+// test server.
+type testGsutilCommunicator struct {
+	packer.MockCommunicator
+	server *testserver.Server
+}
+
+func (c *testGsutilCommunicator) Start(cmd *packer.RemoteCmd) error {
+	fields := strings.Fields(cmd.Command)
+	for i, f := range fields {
+		if f == "cp" && i+2 < len(fields) && strings.HasPrefix(fields[i+2], "gs://") {
+			bucket := strings.TrimPrefix(fields[i+2], "gs://")
+			c.server.PutObject(bucket, filepath.Base(fields[i+1]), []byte("tarball"))
+		}
+	}
+	return c.MockCommunicator.Start(cmd)
+}
+
+// testRun runs a complete build against a test server.
+func testRun(t *testing.T, server *testserver.Server, raw map[string]interface{}, comm packer.Communicator) (packer.Artifact, error) {
+	return testRunConnect(t, server, raw, &stepTestCommunicator{comm: comm})
+}
+
+// testRunConnect runs a complete build against a test server, connecting to
+// the instance with connect.
+func testRunConnect(t *testing.T, server *testserver.Server, raw map[string]interface{}, connect multistep.Step) (packer.Artifact, error) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer setCredentialsEnv(t, "", dir, server.MetadataHost())()
+
+	raw["compute_endpoint"] = server.ComputeEndpoint()
+	b := testBuilder(t, raw)
+	b.connect = connect
+	ui := &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: ioutil.Discard,
+	}
+	return b.Run(ui, &packer.DispatchHook{}, nil)
+}
+
+// testImageRequest returns the image inserted through the test server.
+func testImageRequest(t *testing.T, server *testserver.Server) *compute.Image {
+	for _, r := range server.Requests() {
+		if r.Method == "POST" && strings.HasSuffix(r.Path, "/global/images") {
+			var image *compute.Image
+			if err := json.Unmarshal(r.Body, &image); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			return image
+		}
+	}
+	t.Fatal("no image was inserted")
+	return nil
+}
+
+func TestBuilderRun_disk(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	artifact, err := testRun(t, server, testConfig(), new(packer.MockCommunicator))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if server.Image(artifact.Id()) == nil {
+		t.Fatalf("image %s was not created", artifact.Id())
+	}
+	image := testImageRequest(t, server)
+	if image.RawDisk != nil || !strings.Contains(image.SourceDisk, "/zones/us-central1-a/disks/") {
+		t.Fatalf("bad image request: %#v", image)
+	}
+	if len(server.Instances()) != 0 || len(server.Disks()) != 0 {
+		t.Fatalf("resources left behind: %v %v", server.Instances(), server.Disks())
+	}
+}
+
+func TestBuilderRun_sharedVPC(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	network := &compute.Network{Name: "vpc"}
+	server.AddNetwork("host", network)
+	server.AddSubnetwork("host", "us-central1", &compute.Subnetwork{Name: "build", Network: network.SelfLink})
+	raw := testConfig()
+	raw["network"] = "vpc"
+	raw["network_project_id"] = "host"
+	raw["subnetwork"] = "build"
+	if _, err := testRun(t, server, raw, new(packer.MockCommunicator)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	instance := testLastRequest(t, server, "POST", "/instances")
+	ni := instance["networkInterfaces"].([]interface{})[0].(map[string]interface{})
+	if ni["network"] != network.SelfLink || !strings.HasSuffix(ni["subnetwork"].(string), "/host/regions/us-central1/subnetworks/build") {
+		t.Fatalf("bad network interface: %v", ni)
+	}
+}
+
+func TestBuilderRun_preempted(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	raw := testConfig()
+	raw["preemptible"] = true
+	connect := &stepTestPreempt{server: server, preemptions: 2}
+	artifact, err := testRunConnect(t, server, raw, connect)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if server.Image(artifact.Id()) == nil {
+		t.Fatalf("image %s was not created", artifact.Id())
+	}
+	inserts := 0
+	for _, r := range server.Requests() {
+		if r.Method == "POST" && strings.HasSuffix(r.Path, "/instances") {
+			inserts++
+		}
+	}
+	if inserts != 3 {
+		t.Fatalf("expected 3 instances, got %d", inserts)
+	}
+	instance := testLastRequest(t, server, "POST", "/instances")
+	scheduling, ok := instance["scheduling"].(map[string]interface{})
+	if !ok || scheduling["preemptible"] != true || scheduling["automaticRestart"] != false {
+		t.Fatalf("bad scheduling: %v", instance["scheduling"])
+	}
+	if len(server.Instances()) != 0 || len(server.Disks()) != 0 {
+		t.Fatalf("resources left behind: %v %v", server.Instances(), server.Disks())
+	}
+}
+
+func TestBuilderRun_preemptedTooOften(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	raw := testConfig()
+	raw["preemptible"] = true
+	raw["preemptible_attempts"] = 2
+	connect := &stepTestPreempt{server: server, preemptions: 2}
+	_, err := testRunConnect(t, server, raw, connect)
+	if err == nil || !strings.Contains(err.Error(), "preempted 2 times") {
+		t.Fatalf("expected the build to fail after 2 preemptions, got: %v", err)
+	}
+	if connect.runs != 2 {
+		t.Fatalf("expected 2 attempts, got %d", connect.runs)
+	}
+	if len(server.Instances()) != 0 || len(server.Disks()) != 0 {
+		t.Fatalf("resources left behind: %v %v", server.Instances(), server.Disks())
+	}
+}
+
+func TestBuilderRun_fallbackZones(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	server.AddZone("us-central1-b")
+	server.AddZone("us-central1-c")
+	server.ExhaustZone("us-central1-a")
+	raw := testConfig()
+	raw["fallback_zones"] = []string{"us-central1-b", "us-central1-c"}
+	artifact, err := testRun(t, server, raw, new(packer.MockCommunicator))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(artifact.String(), "in zone us-central1-b") {
+		t.Fatalf("bad artifact: %s", artifact.String())
+	}
+	image := testImageRequest(t, server)
+	if !strings.Contains(image.SourceDisk, "/zones/us-central1-b/disks/") {
+		t.Fatalf("bad image request: %#v", image)
+	}
+	if len(server.Instances()) != 0 || len(server.Disks()) != 0 {
+		t.Fatalf("resources left behind: %v %v", server.Instances(), server.Disks())
+	}
+
+	// Other errors do not fall back.
+	server.ExhaustZone("us-central1-b")
+	raw["machine_type"] = "n1-huge-1"
+	if _, err := testRun(t, server, raw, new(packer.MockCommunicator)); err == nil || strings.Contains(err.Error(), "us-central1-c") {
+		t.Fatalf("expected the build to fail without trying us-central1-c, got: %v", err)
+	}
+}
+
+func TestBuilderRun_tarball(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	raw := testConfig()
+	raw["image_method"] = imageMethodTarball
+	raw["bucket_name"] = "packer-images"
+	comm := &testGsutilCommunicator{server: server}
+	artifact, err := testRun(t, server, raw, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if server.Image(artifact.Id()) == nil {
+		t.Fatalf("image %s was not created", artifact.Id())
+	}
+	image := testImageRequest(t, server)
+	source := "https://storage.cloud.google.com/packer-images/" + artifact.Id() + ".tar.gz"
+	if image.SourceType != "RAW" || image.RawDisk == nil ||
+		image.RawDisk.ContainerType != "TAR" || image.RawDisk.Source != source {
+		t.Fatalf("bad image request: %#v", image)
+	}
+	buildId := image.Labels[buildIdLabel]
+	if buildId == "" || !strings.Contains(comm.StartCmd.Command, "-h x-goog-meta-packer-build-id:"+buildId+" ") {
+		t.Fatalf("the tarball should be labelled with the image's build ID %q: %s", buildId, comm.StartCmd.Command)
+	}
+	if len(server.Instances()) != 0 {
+		t.Fatalf("instances left behind: %v", server.Instances())
+	}
+}
+
+func TestBuilderRun_missingTarball(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	raw := testConfig()
+	raw["image_method"] = imageMethodTarball
+	raw["bucket_name"] = "packer-images"
+	if _, err := testRun(t, server, raw, new(packer.MockCommunicator)); err == nil {
+		t.Fatal("build should fail when the tarball was not uploaded")
+	}
+	if len(server.Instances()) != 0 {
+		t.Fatalf("instances left behind: %v", server.Instances())
+	}
+}
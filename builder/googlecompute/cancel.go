@@ -0,0 +1,64 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"errors"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// errCancelled is returned by waits and remote commands that were aborted
+// because the build was cancelled.
+var errCancelled = errors.New("Build was cancelled.")
+
+// cancelChannel returns the channel in state that is closed when the build
+// is cancelled. It returns nil, which is never closed, if state has none.
+func cancelChannel(state multistep.StateBag) <-chan struct{} {
+	if cancel, ok := state.GetOk("cancel"); ok {
+		return cancel.(<-chan struct{})
+	}
+	return nil
+}
+
+// buildCancelled reports whether the build in state was cancelled.
+func buildCancelled(state multistep.StateBag) bool {
+	select {
+	case <-cancelChannel(state):
+		return true
+	default:
+		return false
+	}
+}
+
+// cleanupClient returns the client in state used by step cleanups. Unlike
+// the steps' client, its calls keep retrying after the build is cancelled.
+func cleanupClient(state multistep.StateBag) ComputeAPI {
+	if client, ok := state.GetOk("cleanup_client"); ok {
+		return client.(ComputeAPI)
+	}
+	return state.Get("client").(ComputeAPI)
+}
+
+// runRemoteCmd runs cmd on the instance, showing its output. If the build
+// is cancelled first, errCancelled is returned without waiting for the
+// command, which ends when the instance is destroyed.
+func runRemoteCmd(state multistep.StateBag, cmd *packer.RemoteCmd) error {
+	var (
+		comm = state.Get("communicator").(packer.Communicator)
+		ui   = state.Get("ui").(packer.Ui)
+	)
+	result := make(chan error, 1)
+	go func() {
+		result <- cmd.StartWithUi(comm, ui)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-cancelChannel(state):
+		return errCancelled
+	}
+}
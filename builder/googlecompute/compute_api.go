@@ -0,0 +1,85 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"google.golang.org/api/compute/v1"
+)
+
+// ComputeAPI represents the Google Compute Engine operations used by the
+// builder. It is implemented by *GoogleComputeClient and, for tests, by
+// *FakeComputeAPI.
+type ComputeAPI interface {
+	// GetZone returns a *compute.Zone representing the named zone.
+	GetZone(name string) (*compute.Zone, error)
+
+	// GetMachineType returns a *compute.MachineType representing the named
+	// machine type.
+	GetMachineType(name, zone string) (*compute.MachineType, error)
+
+	// GetImage returns a *compute.Image representing the named image.
+	GetImage(name string) (*compute.Image, error)
+
+	// GetImageFromFamily returns a *compute.Image representing the newest
+	// image in the named family that is not deprecated.
+	GetImageFromFamily(family string) (*compute.Image, error)
+
+	// GetNetwork returns a *compute.Network representing the named network
+	// in project.
+	GetNetwork(project, name string) (*compute.Network, error)
+
+	// GetSubnetwork returns a *compute.Subnetwork representing the named
+	// subnetwork in the region of project.
+	GetSubnetwork(project, region, name string) (*compute.Subnetwork, error)
+
+	// CreateInstance creates an instance based on the supplied
+	// instanceConfig. Returns a Zone Operation.
+	CreateInstance(zone string, instanceConfig *InstanceConfig) (*compute.Operation, error)
+
+	// InstanceStatus returns the status of the named instance.
+	InstanceStatus(zone, name string) (string, error)
+
+	// GetNatIP returns the public IPv4 address of the named instance.
+	// It is an error if the instance has none.
+	GetNatIP(zone, name string) (string, error)
+
+	// GetInternalIP returns the internal IPv4 address of the named instance
+	// in its VPC network.
+	GetInternalIP(zone, name string) (string, error)
+
+	// ListInstances returns the instances in the zone.
+	ListInstances(zone string) ([]*compute.Instance, error)
+
+	// DeleteInstance deletes the named instance. Returns a Zone Operation.
+	DeleteInstance(zone, name string) (*compute.Operation, error)
+
+	// GetDisk returns a *compute.Disk representing the named persistent disk.
+	GetDisk(zone, name string) (*compute.Disk, error)
+
+	// ListDisks returns the persistent disks in the zone.
+	ListDisks(zone string) ([]*compute.Disk, error)
+
+	// DeleteDisk deletes the named persistent disk. Returns a Zone Operation.
+	DeleteDisk(zone, name string) (*compute.Operation, error)
+
+	// CreateImage registers an image from a tarball stored in Google Cloud
+	// Storage, with the given labels. Returns a Global Operation.
+	CreateImage(name, description, sourceURL string, labels map[string]string) (*compute.Operation, error)
+
+	// CreateImageFromDisk registers an image from a persistent disk, with
+	// the given labels. Returns a Global Operation.
+	CreateImageFromDisk(name, description, sourceDisk string, labels map[string]string) (*compute.Operation, error)
+
+	// DeleteImage deletes the named image. Returns a Global Operation.
+	DeleteImage(name string) (*compute.Operation, error)
+
+	// ZoneOperationStatus returns the status of the named zone operation.
+	ZoneOperationStatus(zone, name string) (string, error)
+
+	// GlobalOperationStatus returns the status of the named global operation.
+	GlobalOperationStatus(name string) (string, error)
+}
+
+var _ ComputeAPI = new(GoogleComputeClient)
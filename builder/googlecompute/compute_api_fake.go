@@ -0,0 +1,564 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// FakeComputeAPI is an in-memory ComputeAPI used to test the builder steps
+// without a network. It simulates instances, disks, images and the zone and
+// global operations that create and delete them.
+//
+// Operations complete after OperationPolls status checks. A method named in
+// Errors fails immediately with that error; a method named in
+// OperationErrors returns an operation that finishes with that error, as an
+// *OperationError like the real client's, and has no effect.
+type FakeComputeAPI struct {
+	ProjectId string
+
+	Zones        map[string]*compute.Zone
+	MachineTypes map[string]*compute.MachineType
+	Networks     map[string]*compute.Network
+	Subnetworks  map[string]*compute.Subnetwork
+	Images       map[string]*compute.Image
+	Instances    map[string]*compute.Instance
+	Disks        map[string]*compute.Disk
+
+	Errors          map[string]error
+	OperationErrors map[string]error
+	OperationPolls  int
+
+	// Calls records the name of every method called, in order.
+	Calls []string
+	// OnCall, if set, is called with the name of every method called,
+	// before it takes effect. It must not call the FakeComputeAPI.
+	OnCall func(method string)
+
+	mu         sync.Mutex
+	operations map[string]*fakeOperation
+	nextId     int
+}
+
+// fakeOperation is an operation tracked by FakeComputeAPI.
+type fakeOperation struct {
+	operation *compute.Operation
+	polls     int
+	err       error
+}
+
+// NewFakeComputeAPI returns a *FakeComputeAPI for projectId with the zone
+// us-central1-a, the n1-standard-1 machine type, the default network and the
+// debian-7-wheezy-v20131014 image.
+func NewFakeComputeAPI(projectId string) *FakeComputeAPI {
+	f := &FakeComputeAPI{
+		ProjectId:       projectId,
+		Zones:           make(map[string]*compute.Zone),
+		MachineTypes:    make(map[string]*compute.MachineType),
+		Networks:        make(map[string]*compute.Network),
+		Subnetworks:     make(map[string]*compute.Subnetwork),
+		Images:          make(map[string]*compute.Image),
+		Instances:       make(map[string]*compute.Instance),
+		Disks:           make(map[string]*compute.Disk),
+		Errors:          make(map[string]error),
+		OperationErrors: make(map[string]error),
+		operations:      make(map[string]*fakeOperation),
+	}
+	f.Zones["us-central1-a"] = &compute.Zone{
+		Name:     "us-central1-a",
+		Region:   f.link("regions/us-central1"),
+		SelfLink: f.link("zones/us-central1-a"),
+		Status:   "UP",
+	}
+	f.MachineTypes["n1-standard-1"] = &compute.MachineType{
+		Name:     "n1-standard-1",
+		SelfLink: f.link("zones/us-central1-a/machineTypes/n1-standard-1"),
+	}
+	f.Networks["default"] = &compute.Network{
+		Name:     "default",
+		SelfLink: f.link("global/networks/default"),
+	}
+	f.Images["debian-7-wheezy-v20131014"] = &compute.Image{
+		DiskSizeGb: 10,
+		Name:       "debian-7-wheezy-v20131014",
+		SelfLink:   f.link("global/images/debian-7-wheezy-v20131014"),
+		Status:     "READY",
+	}
+	return f
+}
+
+// link returns the fake self link of a resource in the project.
+func (f *FakeComputeAPI) link(path string) string {
+	return fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/%s", f.ProjectId, path)
+}
+
+// notFound returns the error the API returns for a missing resource.
+func notFound(kind, name string) error {
+	return &googleapi.Error{
+		Code:    http.StatusNotFound,
+		Message: fmt.Sprintf("%s does not exist: %s", kind, name),
+	}
+}
+
+// call records a call to method and returns the error configured for it.
+// f.mu must be held.
+func (f *FakeComputeAPI) call(method string) error {
+	f.Calls = append(f.Calls, method)
+	if f.OnCall != nil {
+		f.OnCall(method)
+	}
+	return f.Errors[method]
+}
+
+// startOperation returns a new operation started by method. The effect is
+// applied unless an operation error is configured for method. f.mu must be
+// held.
+func (f *FakeComputeAPI) startOperation(method, zone string, effect func()) *compute.Operation {
+	f.nextId++
+	o := &fakeOperation{
+		operation: &compute.Operation{
+			Name:          fmt.Sprintf("operation-%d", f.nextId),
+			OperationType: method,
+			Status:        "PENDING",
+			Zone:          zone,
+		},
+		err: f.OperationErrors[method],
+	}
+	if o.err == nil {
+		effect()
+	}
+	f.operations[o.operation.Name] = o
+	return o.operation
+}
+
+// operationStatus advances and returns the status of the named operation.
+// f.mu must be held.
+func (f *FakeComputeAPI) operationStatus(zone, name string) (string, error) {
+	o, ok := f.operations[name]
+	if !ok || o.operation.Zone != zone {
+		return "", fmt.Errorf("operation not found: %s", name)
+	}
+	if o.polls < f.OperationPolls {
+		o.polls++
+		o.operation.Status = "RUNNING"
+		return o.operation.Status, nil
+	}
+	o.operation.Status = "DONE"
+	if _, ok := o.err.(*OperationError); o.err != nil && !ok {
+		return o.operation.Status, &OperationError{
+			Errors: []*compute.OperationErrorErrors{{Message: o.err.Error()}},
+		}
+	}
+	return o.operation.Status, o.err
+}
+
+// GetZone returns the named zone.
+func (f *FakeComputeAPI) GetZone(name string) (*compute.Zone, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetZone"); err != nil {
+		return nil, err
+	}
+	zone, ok := f.Zones[name]
+	if !ok {
+		return nil, errors.New("Zone does not exist: " + name)
+	}
+	return zone, nil
+}
+
+// GetMachineType returns the named machine type.
+func (f *FakeComputeAPI) GetMachineType(name, zone string) (*compute.MachineType, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetMachineType"); err != nil {
+		return nil, err
+	}
+	machineType, ok := f.MachineTypes[name]
+	if !ok || machineType.Deprecated != nil {
+		return nil, errors.New("Machine Type does not exist: " + name)
+	}
+	return machineType, nil
+}
+
+// GetImage returns the named image. Image URLs are accepted, but every image
+// is treated as belonging to the project.
+func (f *FakeComputeAPI) GetImage(name string) (*compute.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetImage"); err != nil {
+		return nil, err
+	}
+	_, name, err := parseImageURL(name, "images")
+	if err != nil {
+		return nil, err
+	}
+	image, ok := f.Images[name]
+	if !ok {
+		return nil, errors.New("Image does not exist: " + name)
+	}
+	return image, nil
+}
+
+// GetImageFromFamily returns the newest image in the named family that is
+// not deprecated.
+func (f *FakeComputeAPI) GetImageFromFamily(family string) (*compute.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetImageFromFamily"); err != nil {
+		return nil, err
+	}
+	_, family, err := parseImageURL(family, "images/family")
+	if err != nil {
+		return nil, err
+	}
+	var images []*compute.Image
+	for _, image := range f.Images {
+		if image.Family == family {
+			images = append(images, image)
+		}
+	}
+	image := newestImage(images)
+	if image == nil {
+		return nil, errors.New("Image family does not exist: " + family)
+	}
+	return image, nil
+}
+
+// GetNetwork returns the named network. Networks of every project are
+// looked up in Networks.
+func (f *FakeComputeAPI) GetNetwork(project, name string) (*compute.Network, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetNetwork"); err != nil {
+		return nil, err
+	}
+	network, ok := f.Networks[name]
+	if !ok {
+		return nil, errors.New("Network does not exist: " + name)
+	}
+	return network, nil
+}
+
+// GetSubnetwork returns the named subnetwork in region. Subnetworks of every
+// project are looked up in Subnetworks, keyed by region and name, e.g.
+// us-central1/build.
+func (f *FakeComputeAPI) GetSubnetwork(project, region, name string) (*compute.Subnetwork, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetSubnetwork"); err != nil {
+		return nil, err
+	}
+	subnetwork, ok := f.Subnetworks[region+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("Subnetwork does not exist in region %s: %s", region, name)
+	}
+	return subnetwork, nil
+}
+
+// CreateInstance creates a RUNNING instance along with the disks described
+// by InitializeParams. Every ONE_TO_ONE_NAT access config is given a NAT IP.
+func (f *FakeComputeAPI) CreateInstance(zone string, instanceConfig *InstanceConfig) (*compute.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateInstance"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Instances[instanceConfig.Name]; ok {
+		return nil, errors.New("Instance already exists: " + instanceConfig.Name)
+	}
+	operation := f.startOperation("CreateInstance", zone, func() {
+		instance := &compute.Instance{
+			Description:     instanceConfig.Description,
+			Labels:          instanceConfig.Labels,
+			MachineType:     instanceConfig.MachineType,
+			Metadata:        instanceConfig.Metadata,
+			MinCpuPlatform:  instanceConfig.MinCpuPlatform,
+			Scheduling:      instanceConfig.Scheduling,
+			Name:            instanceConfig.Name,
+			SelfLink:        f.link(fmt.Sprintf("zones/%s/instances/%s", zone, instanceConfig.Name)),
+			ServiceAccounts: instanceConfig.ServiceAccounts,
+			Status:          "RUNNING",
+			Tags:            instanceConfig.Tags,
+			Zone:            zone,
+		}
+		for _, ad := range instanceConfig.Disks {
+			d := *ad
+			if p := ad.InitializeParams; p != nil {
+				f.Disks[p.DiskName] = &compute.Disk{
+					Labels:      p.Labels,
+					Name:        p.DiskName,
+					SelfLink:    f.link(fmt.Sprintf("zones/%s/disks/%s", zone, p.DiskName)),
+					SizeGb:      p.DiskSizeGb,
+					SourceImage: p.SourceImage,
+					Status:      "READY",
+					Type:        p.DiskType,
+					Users:       []string{instance.SelfLink},
+					Zone:        zone,
+				}
+				d.Source = f.Disks[p.DiskName].SelfLink
+				d.InitializeParams = nil
+			}
+			instance.Disks = append(instance.Disks, &d)
+		}
+		for i, ni := range instanceConfig.NetworkInterfaces {
+			n := &compute.NetworkInterface{
+				Name:       fmt.Sprintf("nic%d", i),
+				Network:    ni.Network,
+				NetworkIP:  fmt.Sprintf("10.240.0.%d", f.nextId),
+				Subnetwork: ni.Subnetwork,
+			}
+			for _, ac := range ni.AccessConfigs {
+				c := *ac
+				if c.Type == "ONE_TO_ONE_NAT" {
+					c.NatIP = fmt.Sprintf("192.0.2.%d", f.nextId)
+				}
+				n.AccessConfigs = append(n.AccessConfigs, &c)
+			}
+			instance.NetworkInterfaces = append(instance.NetworkInterfaces, n)
+		}
+		f.Instances[instance.Name] = instance
+	})
+	return operation, nil
+}
+
+// InstanceStatus returns the status of the named instance.
+func (f *FakeComputeAPI) InstanceStatus(zone, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("InstanceStatus"); err != nil {
+		return "", err
+	}
+	instance, ok := f.Instances[name]
+	if !ok || instance.Zone != zone {
+		return "", notFound("Instance", name)
+	}
+	return instance.Status, nil
+}
+
+// GetNatIP returns the NAT IP of the named instance.
+func (f *FakeComputeAPI) GetNatIP(zone, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetNatIP"); err != nil {
+		return "", err
+	}
+	instance, ok := f.Instances[name]
+	if !ok || instance.Zone != zone {
+		return "", notFound("Instance", name)
+	}
+	for _, ni := range instance.NetworkInterfaces {
+		for _, ac := range ni.AccessConfigs {
+			if ac.NatIP != "" {
+				return ac.NatIP, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Instance %s has no external IP address", name)
+}
+
+// GetInternalIP returns the internal IP of the named instance.
+func (f *FakeComputeAPI) GetInternalIP(zone, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetInternalIP"); err != nil {
+		return "", err
+	}
+	instance, ok := f.Instances[name]
+	if !ok || instance.Zone != zone {
+		return "", notFound("Instance", name)
+	}
+	for _, ni := range instance.NetworkInterfaces {
+		if ni.NetworkIP != "" {
+			return ni.NetworkIP, nil
+		}
+	}
+	return "", fmt.Errorf("Instance %s has no internal IP address", name)
+}
+
+// DeleteInstance deletes the named instance and its auto-delete disks.
+func (f *FakeComputeAPI) DeleteInstance(zone, name string) (*compute.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteInstance"); err != nil {
+		return nil, err
+	}
+	instance, ok := f.Instances[name]
+	if !ok || instance.Zone != zone {
+		return nil, notFound("Instance", name)
+	}
+	operation := f.startOperation("DeleteInstance", zone, func() {
+		for _, ad := range instance.Disks {
+			for diskName, disk := range f.Disks {
+				if disk.SelfLink != ad.Source {
+					continue
+				}
+				if ad.AutoDelete {
+					delete(f.Disks, diskName)
+				} else {
+					disk.Users = nil
+				}
+			}
+		}
+		delete(f.Instances, name)
+	})
+	return operation, nil
+}
+
+// ListInstances returns the instances in the zone.
+func (f *FakeComputeAPI) ListInstances(zone string) ([]*compute.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ListInstances"); err != nil {
+		return nil, err
+	}
+	var instances []*compute.Instance
+	for _, instance := range f.Instances {
+		if instance.Zone == zone {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+// GetDisk returns the named persistent disk.
+func (f *FakeComputeAPI) GetDisk(zone, name string) (*compute.Disk, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetDisk"); err != nil {
+		return nil, err
+	}
+	disk, ok := f.Disks[name]
+	if !ok || disk.Zone != zone {
+		return nil, notFound("Disk", name)
+	}
+	return disk, nil
+}
+
+// DeleteDisk deletes the named persistent disk.
+func (f *FakeComputeAPI) DeleteDisk(zone, name string) (*compute.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteDisk"); err != nil {
+		return nil, err
+	}
+	disk, ok := f.Disks[name]
+	if !ok || disk.Zone != zone {
+		return nil, notFound("Disk", name)
+	}
+	operation := f.startOperation("DeleteDisk", zone, func() {
+		delete(f.Disks, name)
+	})
+	return operation, nil
+}
+
+// ListDisks returns the persistent disks in the zone.
+func (f *FakeComputeAPI) ListDisks(zone string) ([]*compute.Disk, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ListDisks"); err != nil {
+		return nil, err
+	}
+	var disks []*compute.Disk
+	for _, disk := range f.Disks {
+		if disk.Zone == zone {
+			disks = append(disks, disk)
+		}
+	}
+	return disks, nil
+}
+
+// CreateImage registers an image from a tarball.
+func (f *FakeComputeAPI) CreateImage(name, description, sourceURL string, labels map[string]string) (*compute.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateImage"); err != nil {
+		return nil, err
+	}
+	image := &compute.Image{
+		Description: description,
+		Labels:      labels,
+		Name:        name,
+		RawDisk: &compute.ImageRawDisk{
+			ContainerType: "TAR",
+			Source:        sourceURL,
+		},
+		SourceType: "RAW",
+	}
+	return f.insertImage("CreateImage", image)
+}
+
+// CreateImageFromDisk registers an image from a persistent disk.
+func (f *FakeComputeAPI) CreateImageFromDisk(name, description, sourceDisk string, labels map[string]string) (*compute.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateImageFromDisk"); err != nil {
+		return nil, err
+	}
+	image := &compute.Image{
+		Description: description,
+		Labels:      labels,
+		Name:        name,
+		SourceDisk:  sourceDisk,
+		SourceType:  "RAW",
+	}
+	return f.insertImage("CreateImageFromDisk", image)
+}
+
+// insertImage adds image to the project. f.mu must be held.
+func (f *FakeComputeAPI) insertImage(method string, image *compute.Image) (*compute.Operation, error) {
+	if _, ok := f.Images[image.Name]; ok {
+		return nil, errors.New("Image already exists: " + image.Name)
+	}
+	operation := f.startOperation(method, "", func() {
+		image.SelfLink = f.link("global/images/" + image.Name)
+		image.Status = "READY"
+		f.Images[image.Name] = image
+	})
+	return operation, nil
+}
+
+// DeleteImage deletes the named image.
+func (f *FakeComputeAPI) DeleteImage(name string) (*compute.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteImage"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Images[name]; !ok {
+		return nil, errors.New("Image does not exist: " + name)
+	}
+	operation := f.startOperation("DeleteImage", "", func() {
+		delete(f.Images, name)
+	})
+	return operation, nil
+}
+
+// ZoneOperationStatus returns the status of the named zone operation.
+func (f *FakeComputeAPI) ZoneOperationStatus(zone, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ZoneOperationStatus"); err != nil {
+		return "", err
+	}
+	return f.operationStatus(zone, name)
+}
+
+// GlobalOperationStatus returns the status of the named global operation.
+func (f *FakeComputeAPI) GlobalOperationStatus(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GlobalOperationStatus"); err != nil {
+		return "", err
+	}
+	return f.operationStatus("", name)
+}
+
+var _ ComputeAPI = new(FakeComputeAPI)
@@ -0,0 +1,214 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+// metadataEndpoint is the base URL of the GCE metadata server. The host can
+// be overridden with the GCE_METADATA_HOST environment variable.
+var metadataEndpoint = "http://metadata.google.internal"
+
+// tokenSource represents anything that can supply an OAuth access token.
+type tokenSource interface {
+	Token() (*oauth2.Token, error)
+}
+
+// jwtTokenSource obtains access tokens by asserting a JWT signed with a
+// service account private key.
+type jwtTokenSource struct {
+	account *accountFile
+}
+
+// Token asserts a new JWT and returns the resulting access token.
+func (s *jwtTokenSource) Token() (*oauth2.Token, error) {
+	c := &jwt.Config{
+		Email:      s.account.ClientEmail,
+		PrivateKey: []byte(s.account.PrivateKey),
+		Scopes:     scopes(),
+		TokenURL:   s.account.TokenURI,
+	}
+	return c.TokenSource(context.Background()).Token()
+}
+
+// authorizedUser represents the user credentials written by
+// `gcloud auth application-default login`.
+type authorizedUser struct {
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refreshTokenSource obtains access tokens by exchanging a refresh token.
+type refreshTokenSource struct {
+	user *authorizedUser
+}
+
+// Token exchanges the refresh token for a new access token.
+func (s *refreshTokenSource) Token() (*oauth2.Token, error) {
+	c := &oauth2.Config{
+		ClientID:     s.user.ClientId,
+		ClientSecret: s.user.ClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: defaultTokenURI},
+		Scopes:       scopes(),
+	}
+	token := &oauth2.Token{RefreshToken: s.user.RefreshToken}
+	return c.TokenSource(context.Background(), token).Token()
+}
+
+// metadataTokenSource obtains access tokens for the default service account
+// of the GCE instance the builder is running on.
+type metadataTokenSource struct {
+	endpoint string
+}
+
+// Token requests an access token from the metadata server.
+func (s *metadataTokenSource) Token() (*oauth2.Token, error) {
+	url := s.endpoint + "/computeMetadata/v1/instance/service-accounts/default/token"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Failed parsing metadata server token: %s", err)
+	}
+	if body.AccessToken == "" {
+		return nil, errors.New("metadata server returned an empty access token")
+	}
+	return &oauth2.Token{
+		AccessToken: body.AccessToken,
+		Expiry:      time.Now().Add(time.Duration(body.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// defaultTokenSource discovers Application Default Credentials. It tries, in
+// order, the file named by GOOGLE_APPLICATION_CREDENTIALS, the gcloud
+// well-known credentials file and the GCE metadata server.
+func defaultTokenSource() (tokenSource, error) {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		log.Printf("Using credentials from GOOGLE_APPLICATION_CREDENTIALS: %s", path)
+		ts, err := loadCredentialsFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed loading GOOGLE_APPLICATION_CREDENTIALS: %s", err)
+		}
+		return ts, nil
+	}
+	if path := wellKnownCredentialsFile(); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			log.Printf("Using gcloud application default credentials: %s", path)
+			ts, err := loadCredentialsFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("Failed loading %s: %s", path, err)
+			}
+			return ts, nil
+		}
+	}
+	endpoint := metadataEndpoint
+	if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+		endpoint = "http://" + host
+	}
+	if onGCE(endpoint) {
+		log.Printf("Using credentials from the metadata server: %s", endpoint)
+		return &metadataTokenSource{endpoint: endpoint}, nil
+	}
+	return nil, errors.New("could not find default credentials; set account_file, " +
+		"GOOGLE_APPLICATION_CREDENTIALS or run on a GCE instance")
+}
+
+// loadCredentialsFile loads a service account or authorized user credentials
+// file identified by path.
+func loadCredentialsFile(path string) (tokenSource, error) {
+	var f struct {
+		Type string `json:"type"`
+	}
+	credentialsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(credentialsBytes, &f); err != nil {
+		return nil, fmt.Errorf("%s is not valid JSON: %s", path, err)
+	}
+	switch f.Type {
+	case "service_account":
+		a, err := loadAccountFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &jwtTokenSource{account: a}, nil
+	case "authorized_user":
+		var u *authorizedUser
+		if err := json.Unmarshal(credentialsBytes, &u); err != nil {
+			return nil, err
+		}
+		if u.RefreshToken == "" {
+			return nil, fmt.Errorf("%s is missing refresh_token", path)
+		}
+		return &refreshTokenSource{user: u}, nil
+	}
+	return nil, fmt.Errorf("%s has unknown credentials type %q", path, f.Type)
+}
+
+// wellKnownCredentialsFile returns the path of the gcloud application
+// default credentials file, or an empty string if it cannot be determined.
+func wellKnownCredentialsFile() string {
+	const name = "application_default_credentials.json"
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, name)
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, "gcloud", name)
+		}
+		return ""
+	}
+	if dir := os.Getenv("HOME"); dir != "" {
+		return filepath.Join(dir, ".config", "gcloud", name)
+	}
+	return ""
+}
+
+// onGCE reports whether the metadata server at endpoint is reachable.
+func onGCE(endpoint string) bool {
+	client := &http.Client{Timeout: 2 * time.Second}
+	req, err := http.NewRequest("GET", endpoint+"/computeMetadata/v1/", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return strings.Contains(resp.Header.Get("Metadata-Flavor"), "Google")
+}
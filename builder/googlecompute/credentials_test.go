@@ -0,0 +1,164 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setCredentialsEnv points every step of the default credentials chain at
+// the supplied values and returns a function restoring the environment.
+func setCredentialsEnv(t *testing.T, credentials, cloudsdkConfig, metadataHost string) func() {
+	names := []string{"GOOGLE_APPLICATION_CREDENTIALS", "CLOUDSDK_CONFIG", "GCE_METADATA_HOST"}
+	values := []string{credentials, cloudsdkConfig, metadataHost}
+	saved := make([]string, len(names))
+	for i, name := range names {
+		saved[i] = os.Getenv(name)
+		if err := os.Setenv(name, values[i]); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	return func() {
+		for i, name := range names {
+			os.Setenv(name, saved[i])
+		}
+	}
+}
+
+func newMetadataServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("missing Metadata-Flavor header on %s", r.URL.Path)
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		switch r.URL.Path {
+		case "/computeMetadata/v1/":
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			fmt.Fprint(w, `{"access_token":"metadata-token","expires_in":3600,"token_type":"Bearer"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestDefaultTokenSource_metadata(t *testing.T) {
+	server := newMetadataServer(t)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer setCredentialsEnv(t, "", dir, strings.TrimPrefix(server.URL, "http://"))()
+
+	ts, err := defaultTokenSource()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := ts.(*metadataTokenSource); !ok {
+		t.Fatalf("bad token source: %#v", ts)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if token.AccessToken != "metadata-token" {
+		t.Fatalf("bad access token: %s", token.AccessToken)
+	}
+	if token.Expiry.IsZero() {
+		t.Fatal("expiry should be set")
+	}
+}
+
+func TestDefaultTokenSource_environment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "user.json")
+	user := `{"type":"authorized_user","client_id":"id","client_secret":"secret","refresh_token":"refresh"}`
+	if err := ioutil.WriteFile(path, []byte(user), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer setCredentialsEnv(t, path, dir, "127.0.0.1:1")()
+
+	ts, err := defaultTokenSource()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	rts, ok := ts.(*refreshTokenSource)
+	if !ok {
+		t.Fatalf("bad token source: %#v", ts)
+	}
+	if rts.user.RefreshToken != "refresh" {
+		t.Fatalf("bad refresh token: %s", rts.user.RefreshToken)
+	}
+}
+
+func TestDefaultTokenSource_wellKnownFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "application_default_credentials.json")
+	if err := ioutil.WriteFile(path, []byte(`{"type":"unknown"}`), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer setCredentialsEnv(t, "", dir, "127.0.0.1:1")()
+
+	_, err = defaultTokenSource()
+	if err == nil || !strings.Contains(err.Error(), "unknown credentials type") {
+		t.Fatalf("expected the well-known file to be used, got: %v", err)
+	}
+}
+
+func TestDefaultTokenSource_none(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer setCredentialsEnv(t, "", dir, "127.0.0.1:1")()
+
+	if _, err := defaultTokenSource(); err == nil {
+		t.Fatal("should fail without any credentials")
+	}
+}
+
+func TestJWTTokenSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("assertion") == "" {
+			t.Errorf("missing JWT assertion: %v", r.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"jwt-token","expires_in":3600,"token_type":"Bearer"}`)
+	}))
+	defer server.Close()
+	fields := testAccountFile()
+	fields["token_uri"] = server.URL
+	path := writeTempJSON(t, fields)
+	defer os.Remove(path)
+	account, err := loadAccountFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	token, err := (&jwtTokenSource{account: account}).Token()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if token.AccessToken != "jwt-token" || token.Expiry.IsZero() {
+		t.Fatalf("bad token: %#v", token)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mitchellh/multistep"
+)
+
+// The labels added to every resource a build creates, so that the resources
+// left behind by crashed builds can be traced and reaped. The creation time
+// is in seconds since the Unix epoch, as label values cannot hold colons.
+const (
+	buildIdLabel = "packer-build-id"
+	createdLabel = "packer-created"
+)
+
+// buildLabels returns the labels of a resource created now by the build in
+// state.
+func buildLabels(state multistep.StateBag) map[string]string {
+	return map[string]string{
+		buildIdLabel: state.Get("build_id").(string),
+		createdLabel: strconv.FormatInt(time.Now().Unix(), 10),
+	}
+}
+
+// parseBuildLabels returns the build ID and creation time in labels. It
+// returns false if the resource was not created by a build.
+func parseBuildLabels(labels map[string]string) (string, time.Time, bool) {
+	buildId, ok := labels[buildIdLabel]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	created, err := strconv.ParseInt(labels[createdLabel], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return buildId, time.Unix(created, 0), true
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// defaultLeakReportFile is the default file listing the resources that
+// builds failed to destroy.
+const defaultLeakReportFile = "packer-googlecompute-leaks.txt"
+
+// reportLeak tells the user that the resource at url could not be destroyed
+// because of err, and appends url to the leak report so that it can be
+// destroyed later.
+func reportLeak(state multistep.StateBag, url string, err error) {
+	var (
+		config = state.Get("config").(config)
+		ui     = state.Get("ui").(packer.Ui)
+	)
+	ui.Error(fmt.Sprintf("Error destroying %s: %s. Please destroy it manually.", url, err))
+	if err := appendLeakReport(config.LeakReportFile, url); err != nil {
+		ui.Error(fmt.Sprintf("Error writing the leak report %s: %s", config.LeakReportFile, err))
+		return
+	}
+	ui.Message(fmt.Sprintf("Added it to the leak report %s", config.LeakReportFile))
+}
+
+// appendLeakReport appends url to the leak report at path.
+func appendLeakReport(path, url string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, url)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
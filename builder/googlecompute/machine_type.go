@@ -0,0 +1,43 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"fmt"
+)
+
+// GCE custom machine type limits. Memory is in MB, and must be a multiple of
+// customMemoryIncrement within the per-vCPU bounds, 0.9GB and 6.5GB.
+const (
+	maxCustomCPUs            = 96
+	customMemoryIncrement    = 256
+	minCustomMemoryPerCPUx10 = 9216
+	maxCustomMemoryPerCPU    = 6656
+)
+
+// customMachineType returns the name of the custom machine type with cpus
+// vCPUs and memoryMb MB of memory, e.g. custom-16-14848.
+func customMachineType(cpus int, memoryMb int64) string {
+	return fmt.Sprintf("custom-%d-%d", cpus, memoryMb)
+}
+
+// checkCustomMachineType returns an error if GCE does not allow a custom
+// machine type with cpus vCPUs and memoryMb MB of memory.
+func checkCustomMachineType(cpus int, memoryMb int64) error {
+	if cpus < 1 || cpus > maxCustomCPUs || (cpus > 1 && cpus%2 != 0) {
+		return fmt.Errorf("custom_cpus must be 1 or an even number up to %d, not %d", maxCustomCPUs, cpus)
+	}
+	if memoryMb%customMemoryIncrement != 0 {
+		return fmt.Errorf("custom_memory_mb must be a multiple of %d, not %d", customMemoryIncrement, memoryMb)
+	}
+	// The smallest multiple of the increment of at least 0.9GB per vCPU.
+	min := int64(cpus) * minCustomMemoryPerCPUx10 / 10
+	min = (min + customMemoryIncrement - 1) / customMemoryIncrement * customMemoryIncrement
+	max := int64(cpus) * maxCustomMemoryPerCPU
+	if memoryMb < min || memoryMb > max {
+		return fmt.Errorf("custom_memory_mb must be between %d and %d for %d vCPUs, not %d", min, max, cpus, memoryMb)
+	}
+	return nil
+}
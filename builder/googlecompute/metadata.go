@@ -0,0 +1,59 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// GCE instance metadata size limits, in bytes.
+const (
+	maxMetadataValueSize = 256 * 1024
+	maxMetadataSize      = 512 * 1024
+)
+
+// startupScriptMetadataKey is the instance metadata key holding the script
+// run when the instance boots.
+const startupScriptMetadataKey = "startup-script"
+
+// loadMetadataFiles adds the contents of the files in files, a map of
+// metadata keys to file paths, to metadata. A key already in metadata is an
+// error.
+func loadMetadataFiles(metadata map[string]string, files map[string]string) error {
+	keys := make([]string, 0, len(files))
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, ok := metadata[k]; ok {
+			return fmt.Errorf("metadata key %s is set more than once", k)
+		}
+		b, err := ioutil.ReadFile(files[k])
+		if err != nil {
+			return fmt.Errorf("Error reading metadata file for %s: %s", k, err)
+		}
+		metadata[k] = string(b)
+	}
+	return nil
+}
+
+// checkMetadataSize verifies metadata is within the GCE size limits for a
+// single value and for all keys and values together.
+func checkMetadataSize(metadata map[string]string) error {
+	total := 0
+	for k, v := range metadata {
+		if len(v) > maxMetadataValueSize {
+			return fmt.Errorf("metadata %s is %d bytes, more than the limit of %d bytes", k, len(v), maxMetadataValueSize)
+		}
+		total += len(k) + len(v)
+	}
+	if total > maxMetadataSize {
+		return fmt.Errorf("metadata is %d bytes in total, more than the limit of %d bytes", total, maxMetadataSize)
+	}
+	return nil
+}
@@ -5,22 +5,39 @@
 package googlecompute
 
 import (
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+
+	"golang.org/x/crypto/pkcs12"
 )
 
-// processPrivateKeyFile.
+// The password Google uses for every PKCS#12 service account key.
+const defaultPKCS12Password = "notasecret"
+
+// processPrivateKeyFile loads a service account private key and returns it
+// as a PKCS#1 PEM block. The file may be a PKCS#12 (.p12) key as downloaded
+// from the Cloud Console, or a PKCS#1 or PKCS#8 PEM key, optionally
+// encrypted with passphrase.
 func processPrivateKeyFile(privateKeyFile, passphrase string) ([]byte, error) {
 	rawPrivateKeyBytes, err := ioutil.ReadFile(privateKeyFile)
 	if err != nil {
-		return nil, fmt.Errorf("Failed loading private key file: %s", err)
+		return nil, err
 	}
 	PEMBlock, _ := pem.Decode(rawPrivateKeyBytes)
 	if PEMBlock == nil {
-		return nil, fmt.Errorf("%s does not contain a vaild private key", privateKeyFile)
+		// Anything that is not PEM is expected to be a PKCS#12 archive.
+		if passphrase == "" {
+			passphrase = defaultPKCS12Password
+		}
+		key, _, err := pkcs12.Decode(rawPrivateKeyBytes, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a PEM key and could not be decoded as PKCS#12: %s", privateKeyFile, err)
+		}
+		return encodeRSAPrivateKey(key, "PKCS#12")
 	}
 	if x509.IsEncryptedPEMBlock(PEMBlock) {
 		if passphrase == "" {
@@ -30,11 +47,44 @@ func processPrivateKeyFile(privateKeyFile, passphrase string) ([]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("Failed decrypting private key: %s", err)
 		}
-		b := &pem.Block{
-			Type:  "RSA PRIVATE KEY",
+		PEMBlock = &pem.Block{
+			Type:  PEMBlock.Type,
 			Bytes: decryptedPrivateKeyBytes,
 		}
-		return pem.EncodeToMemory(b), nil
 	}
-	return rawPrivateKeyBytes, nil
+	return processPEMBlock(PEMBlock)
+}
+
+// processPEMBlock parses a PKCS#1 or PKCS#8 RSA private key and returns it
+// as a PKCS#1 PEM block.
+func processPEMBlock(block *pem.Block) ([]byte, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing PKCS#1 private key: %s", err)
+		}
+		return encodeRSAPrivateKey(key, "PKCS#1")
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing PKCS#8 private key: %s", err)
+		}
+		return encodeRSAPrivateKey(key, "PKCS#8")
+	}
+	return nil, fmt.Errorf("unsupported PEM block type %q, expected \"RSA PRIVATE KEY\" or \"PRIVATE KEY\"", block.Type)
+}
+
+// encodeRSAPrivateKey encodes key as a PKCS#1 PEM block. format names the
+// format key was decoded from and is used in errors.
+func encodeRSAPrivateKey(key interface{}, format string) ([]byte, error) {
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s private key is a %T, only RSA keys are supported", format, key)
+	}
+	b := &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+	}
+	return pem.EncodeToMemory(b), nil
 }
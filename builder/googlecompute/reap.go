@@ -0,0 +1,159 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// defaultReapTimeout is the default time to wait for a reaped resource to be
+// deleted.
+const defaultReapTimeout = 5 * time.Minute
+
+// ReapConfig holds the settings of Reap.
+type ReapConfig struct {
+	// AccountFile is the service account JSON key file. Application Default
+	// Credentials are used if it is empty.
+	AccountFile string
+	// ComputeEndpoint, if not empty, replaces the base URL of the Compute
+	// API.
+	ComputeEndpoint string
+	// ProjectId is the project the builds ran in.
+	ProjectId string
+	// Zones are the zones searched for instances and disks.
+	Zones []string
+	// Bucket, if not empty, is the Cloud Storage bucket searched for the
+	// tarballs uploaded by builds.
+	Bucket string
+	// OlderThan is the age from which resources are reaped.
+	OlderThan time.Duration
+	// Delete deletes the resources found instead of only listing them.
+	Delete bool
+	// Timeout is the time to wait for each resource to be deleted. Defaults
+	// to 5 minutes.
+	Timeout time.Duration
+}
+
+// Reap finds the instances and disks that builds created in the zones, and
+// the tarballs they uploaded to the bucket, more than OlderThan ago, and
+// deletes them if Delete is set. Each resource is written to out as its URL,
+// build ID and creation time. Images are the result of builds, so they are
+// never reaped.
+func Reap(c *ReapConfig, out io.Writer) error {
+	if c.ProjectId == "" {
+		return errors.New("a project must be specified")
+	}
+	if len(c.Zones) == 0 && c.Bucket == "" {
+		return errors.New("at least one zone or a bucket must be specified")
+	}
+	var ts tokenSource
+	if c.AccountFile != "" {
+		account, err := loadAccountFile(c.AccountFile)
+		if err != nil {
+			return fmt.Errorf("Failed parsing account file: %s", err)
+		}
+		ts = &jwtTokenSource{account: account}
+	} else {
+		var err error
+		ts, err = defaultTokenSource()
+		if err != nil {
+			return err
+		}
+	}
+	var client ComputeAPI
+	if len(c.Zones) > 0 {
+		computeClient, err := New(c.ProjectId, c.Zones[0], c.ComputeEndpoint, ts)
+		if err != nil {
+			return err
+		}
+		client = computeClient
+	}
+	var storageClient StorageAPI
+	if c.Bucket != "" {
+		var err error
+		storageClient, err = NewStorage("", ts)
+		if err != nil {
+			return err
+		}
+	}
+	return reap(client, storageClient, c, time.Now(), out)
+}
+
+// reap does the work of Reap using client and storageClient, at the time
+// now. storageClient is only used when c.Bucket is set.
+func reap(client ComputeAPI, storageClient StorageAPI, c *ReapConfig, now time.Time, out io.Writer) error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultReapTimeout
+	}
+	failed := 0
+	report := func(url string, labels map[string]string, destroy func() error) {
+		buildId, created, ok := parseBuildLabels(labels)
+		if !ok || now.Sub(created) < c.OlderThan {
+			return
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\n", url, buildId, created.UTC().Format(time.RFC3339))
+		if !c.Delete {
+			return
+		}
+		if err := destroy(); err != nil {
+			fmt.Fprintf(out, "Error deleting %s: %s\n", url, err)
+			failed++
+			return
+		}
+		fmt.Fprintf(out, "Deleted %s\n", url)
+	}
+	for _, zone := range c.Zones {
+		instances, err := client.ListInstances(zone)
+		if err != nil {
+			return fmt.Errorf("Error listing instances in %s: %s", zone, err)
+		}
+		for _, instance := range instances {
+			name := instance.Name
+			report(instance.SelfLink, instance.Labels, func() error {
+				return destroyInstance(client, zone, name, timeout)
+			})
+		}
+		// The disks are listed once the instances are deleted, as their boot
+		// disks may be deleted with them. Disks still in use are skipped.
+		disks, err := client.ListDisks(zone)
+		if err != nil {
+			return fmt.Errorf("Error listing disks in %s: %s", zone, err)
+		}
+		for _, disk := range disks {
+			if len(disk.Users) > 0 {
+				continue
+			}
+			name := disk.Name
+			report(disk.SelfLink, disk.Labels, func() error {
+				return destroyDisk(client, zone, name, timeout)
+			})
+		}
+	}
+	if c.Bucket != "" {
+		// Tarballs carry the build labels as custom metadata.
+		objects, err := storageClient.ListObjects(c.Bucket)
+		if err != nil {
+			return fmt.Errorf("Error listing objects in %s: %s", c.Bucket, err)
+		}
+		for _, object := range objects {
+			name := object.Name
+			report(fmt.Sprintf("gs://%s/%s", c.Bucket, name), object.Metadata, func() error {
+				err := storageClient.DeleteObject(c.Bucket, name)
+				if isNotFound(err) {
+					return nil
+				}
+				return err
+			})
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d resources could not be deleted", failed)
+	}
+	return nil
+}
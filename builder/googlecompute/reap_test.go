@@ -0,0 +1,159 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/packer-builder-googlecompute/builder/googlecompute/testserver"
+	"google.golang.org/api/compute/v1"
+)
+
+// testReapLabels returns the labels of a resource created by the build
+// buildId, age before now.
+func testReapLabels(buildId string, now time.Time, age time.Duration) map[string]string {
+	return map[string]string{
+		buildIdLabel: buildId,
+		createdLabel: strconv.FormatInt(now.Add(-age).Unix(), 10),
+	}
+}
+
+// testReapClient returns a *FakeComputeAPI with resources created by builds
+// and others, at now.
+func testReapClient(now time.Time) *FakeComputeAPI {
+	client := NewFakeComputeAPI("hashicorp")
+	labels := func(buildId string, age time.Duration) map[string]string {
+		return testReapLabels(buildId, now, age)
+	}
+	instance := func(name string, labels map[string]string) {
+		client.Instances[name] = &compute.Instance{
+			Labels:   labels,
+			Name:     name,
+			SelfLink: client.link("zones/us-central1-a/instances/" + name),
+			Status:   "RUNNING",
+			Zone:     "us-central1-a",
+		}
+	}
+	disk := func(name string, labels map[string]string, users ...string) {
+		client.Disks[name] = &compute.Disk{
+			Labels:   labels,
+			Name:     name,
+			SelfLink: client.link("zones/us-central1-a/disks/" + name),
+			Users:    users,
+			Zone:     "us-central1-a",
+		}
+	}
+	instance("packer-old", labels("old", 48*time.Hour))
+	instance("packer-new", labels("new", time.Hour))
+	instance("web", nil)
+	disk("packer-old", labels("old", 48*time.Hour))
+	disk("packer-attached", labels("attached", 48*time.Hour), client.Instances["web"].SelfLink)
+	disk("packer-new", labels("new", time.Hour))
+	disk("data", map[string]string{buildIdLabel: "bad"})
+	return client
+}
+
+func TestReap(t *testing.T) {
+	now := time.Now()
+	client := testReapClient(now)
+	c := &ReapConfig{
+		Zones:     []string{"us-central1-a"},
+		OlderThan: 24 * time.Hour,
+	}
+	var out bytes.Buffer
+	if err := reap(client, nil, c, now, &out); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	created := now.Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	expected := client.link("zones/us-central1-a/instances/packer-old") + "\told\t" + created + "\n" +
+		client.link("zones/us-central1-a/disks/packer-old") + "\told\t" + created + "\n"
+	if out.String() != expected {
+		t.Fatalf("bad output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+	if len(client.Instances) != 3 || len(client.Disks) != 4 {
+		t.Fatalf("nothing should be deleted: %v %v", client.Instances, client.Disks)
+	}
+
+	c.Delete = true
+	out.Reset()
+	if err := reap(client, nil, c, now, &out); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := client.Instances["packer-old"]; ok || len(client.Instances) != 2 {
+		t.Fatalf("only packer-old should be deleted: %v", client.Instances)
+	}
+	if _, ok := client.Disks["packer-old"]; ok || len(client.Disks) != 3 {
+		t.Fatalf("only packer-old should be deleted: %v", client.Disks)
+	}
+	if strings.Count(out.String(), "Deleted ") != 2 {
+		t.Fatalf("bad output: %s", out.String())
+	}
+}
+
+func TestReap_deleteError(t *testing.T) {
+	now := time.Now()
+	client := testReapClient(now)
+	client.Errors["DeleteInstance"] = errTest
+	c := &ReapConfig{
+		Zones:     []string{"us-central1-a"},
+		OlderThan: 24 * time.Hour,
+		Delete:    true,
+	}
+	var out bytes.Buffer
+	if err := reap(client, nil, c, now, &out); err == nil || !strings.Contains(err.Error(), "1 resources") {
+		t.Fatalf("expected 1 resource to fail, got: %v", err)
+	}
+	if !strings.Contains(out.String(), "Error deleting "+client.Instances["packer-old"].SelfLink) {
+		t.Fatalf("bad output: %s", out.String())
+	}
+	if _, ok := client.Disks["packer-old"]; ok {
+		t.Fatal("the disk should still be deleted")
+	}
+}
+
+func TestReap_bucket(t *testing.T) {
+	server := testserver.NewServer("hashicorp")
+	defer server.Close()
+	now := time.Now()
+	server.PutObjectMetadata("packer-images", "packer-old.tar.gz", []byte("tarball"), testReapLabels("old", now, 48*time.Hour))
+	server.PutObjectMetadata("packer-images", "packer-new.tar.gz", []byte("tarball"), testReapLabels("new", now, time.Hour))
+	server.PutObject("packer-images", "other.tar.gz", []byte("tarball"))
+	storageClient, err := NewStorage(server.StorageEndpoint(), &metadataTokenSource{endpoint: server.URL})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := &ReapConfig{
+		Bucket:    "packer-images",
+		OlderThan: 24 * time.Hour,
+	}
+	var out bytes.Buffer
+	if err := reap(nil, storageClient, c, now, &out); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	created := now.Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	expected := "gs://packer-images/packer-old.tar.gz\told\t" + created + "\n"
+	if out.String() != expected {
+		t.Fatalf("bad output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+	if objects := server.Objects("packer-images"); len(objects) != 3 {
+		t.Fatalf("nothing should be deleted: %v", objects)
+	}
+
+	c.Delete = true
+	out.Reset()
+	if err := reap(nil, storageClient, c, now, &out); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if objects := server.Objects("packer-images"); strings.Join(objects, ",") != "other.tar.gz,packer-new.tar.gz" {
+		t.Fatalf("only packer-old.tar.gz should be deleted: %v", objects)
+	}
+	if !strings.Contains(out.String(), "Deleted gs://packer-images/packer-old.tar.gz") {
+		t.Fatalf("bad output: %s", out.String())
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Retry defaults.
+const (
+	defaultMaxAttempts  = 5
+	defaultInitialDelay = 1 * time.Second
+	defaultMaxDelay     = 30 * time.Second
+)
+
+// retryPolicy controls how API calls failing with transient errors are
+// retried.
+type retryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int
+	// InitialDelay is the delay before the first retry. It doubles with
+	// every further retry, up to MaxDelay.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// defaultRetryPolicy returns the retry policy used when none is configured.
+func defaultRetryPolicy() *retryPolicy {
+	return &retryPolicy{
+		MaxAttempts:  defaultMaxAttempts,
+		InitialDelay: defaultInitialDelay,
+		MaxDelay:     defaultMaxDelay,
+	}
+}
+
+// do calls f until it succeeds, fails with an error that is not worth
+// retrying, or MaxAttempts is reached. Only idempotent calls are retried on
+// errors that may have happened after the request was processed. Closing
+// cancel stops the retries with errCancelled.
+func (p *retryPolicy) do(name string, idempotent bool, cancel <-chan struct{}, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= p.MaxAttempts || !isRetryable(err, idempotent) {
+			return err
+		}
+		delay := p.delay(attempt)
+		log.Printf("%s failed (attempt %d of %d), retrying in %s: %s",
+			name, attempt, p.MaxAttempts, delay, err)
+		select {
+		case <-cancel:
+			return errCancelled
+		case <-time.After(delay):
+		}
+	}
+}
+
+// delay returns the jittered delay after the given attempt: a random
+// duration between half and all of the exponential backoff.
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	d := p.InitialDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// zoneCapacityErrors are the error codes and reasons of requests that failed
+// for lack of resources or quota in a zone.
+var zoneCapacityErrors = map[string]bool{
+	"ZONE_RESOURCE_POOL_EXHAUSTED":              true,
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": true,
+	"QUOTA_EXCEEDED":                            true,
+	"quotaExceeded":                             true,
+	"resourcePoolExhausted":                     true,
+}
+
+// isZoneCapacityError reports whether err means a zone has no capacity or
+// quota left for a new instance, so another zone may succeed.
+func isZoneCapacityError(err error) bool {
+	switch e := err.(type) {
+	case *OperationError:
+		for _, item := range e.Errors {
+			if zoneCapacityErrors[item.Code] {
+				return true
+			}
+		}
+	case *googleapi.Error:
+		for _, item := range e.Errors {
+			if zoneCapacityErrors[item.Reason] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRetryable reports whether err is transient. Rate limit errors are
+// always retryable because the request was rejected before being processed.
+// Backend and connection errors are only retryable for idempotent calls.
+func isRetryable(err error, idempotent bool) bool {
+	if e, ok := err.(*googleapi.Error); ok {
+		for _, item := range e.Errors {
+			switch item.Reason {
+			case "rateLimitExceeded", "userRateLimitExceeded":
+				return true
+			case "backendError", "internalError":
+				return idempotent
+			}
+		}
+		switch e.Code {
+		case 429:
+			return true
+		case 500, 502, 503, 504:
+			return idempotent
+		}
+		return false
+	}
+	if !idempotent {
+		return false
+	}
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*net.OpError); ok {
+		if e.Temporary() || e.Timeout() {
+			return true
+		}
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED:
+		return true
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection reset by peer")
+}
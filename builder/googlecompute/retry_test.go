@@ -0,0 +1,170 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+	connReset := &url.Error{
+		Op:  "Get",
+		URL: "https://www.googleapis.com/compute/v1/projects/hashicorp",
+		Err: &net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}},
+	}
+	cases := []struct {
+		err        error
+		idempotent bool
+		retryable  bool
+	}{
+		{&googleapi.Error{Code: 429}, false, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, false, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, true, true},
+		{&googleapi.Error{Code: 503}, true, true},
+		{&googleapi.Error{Code: 503}, false, false},
+		{&googleapi.Error{Code: 500, Errors: []googleapi.ErrorItem{{Reason: "backendError"}}}, true, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, true, false},
+		{&googleapi.Error{Code: 404}, true, false},
+		{&googleapi.Error{Code: 400}, true, false},
+		{connReset, true, true},
+		{connReset, false, false},
+		{io.EOF, true, true},
+		{errors.New("malformed response"), true, false},
+	}
+	for i, c := range cases {
+		if got := isRetryable(c.err, c.idempotent); got != c.retryable {
+			t.Errorf("%d: isRetryable(%v, %v) = %v, want %v", i, c.err, c.idempotent, got, c.retryable)
+		}
+	}
+}
+
+func TestIsZoneCapacityError(t *testing.T) {
+	cases := []struct {
+		err      error
+		capacity bool
+	}{
+		{&OperationError{Errors: []*compute.OperationErrorErrors{{Code: "ZONE_RESOURCE_POOL_EXHAUSTED"}}}, true},
+		{&OperationError{Errors: []*compute.OperationErrorErrors{{Code: "INVALID"}, {Code: "QUOTA_EXCEEDED"}}}, true},
+		{&OperationError{Errors: []*compute.OperationErrorErrors{{Code: "INVALID"}}}, false},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, false},
+		{errors.New("ZONE_RESOURCE_POOL_EXHAUSTED"), false},
+	}
+	for i, c := range cases {
+		if got := isZoneCapacityError(c.err); got != c.capacity {
+			t.Errorf("%d: isZoneCapacityError(%v) = %v, want %v", i, c.err, got, c.capacity)
+		}
+	}
+}
+
+func TestRetryPolicy_do(t *testing.T) {
+	p := &retryPolicy{MaxAttempts: 3}
+	unavailable := &googleapi.Error{Code: 503}
+
+	calls := 0
+	err := p.do("test", true, nil, func() error {
+		calls++
+		if calls < 3 {
+			return unavailable
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success after 3 calls, got %d calls and err: %v", calls, err)
+	}
+
+	calls = 0
+	err = p.do("test", true, nil, func() error {
+		calls++
+		return unavailable
+	})
+	if err != unavailable || calls != 3 {
+		t.Fatalf("expected failure after 3 calls, got %d calls and err: %v", calls, err)
+	}
+
+	calls = 0
+	notFound := &googleapi.Error{Code: 404}
+	err = p.do("test", true, nil, func() error {
+		calls++
+		return notFound
+	})
+	if err != notFound || calls != 1 {
+		t.Fatalf("expected 404 to fail fast, got %d calls and err: %v", calls, err)
+	}
+}
+
+func TestRetryPolicy_doCancel(t *testing.T) {
+	p := &retryPolicy{MaxAttempts: 3, InitialDelay: time.Hour, MaxDelay: time.Hour}
+	cancel := make(chan struct{})
+	calls := 0
+	err := p.do("test", true, cancel, func() error {
+		calls++
+		close(cancel)
+		return &googleapi.Error{Code: 429}
+	})
+	if err != errCancelled || calls != 1 {
+		t.Fatalf("expected the retries to be cancelled, got %d calls and err: %v", calls, err)
+	}
+}
+
+func TestRetryPolicy_delay(t *testing.T) {
+	p := &retryPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second}
+	cases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, c := range cases {
+		d := p.delay(c.attempt)
+		if d < c.max/2 || d > c.max {
+			t.Errorf("attempt %d: delay %s not within [%s, %s]", c.attempt, d, c.max/2, c.max)
+		}
+	}
+}
+
+func TestGoogleComputeClient_retriesTransientErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name": "us-central1-a", "status": "UP"}`)
+	}))
+	defer server.Close()
+	source := &countingTokenSource{lifetime: time.Hour}
+	client, err := New("hashicorp", "us-central1-a", server.URL+"/", source)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	client.retries = &retryPolicy{MaxAttempts: 3}
+
+	zone, err := client.GetZone("us-central1-a")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if zone.Status != "UP" || requests != 3 {
+		t.Fatalf("expected zone after 3 requests, got %d requests: %#v", requests, zone)
+	}
+}
@@ -1,11 +1,16 @@
 package googlecompute
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 
-	gossh "code.google.com/p/go.crypto/ssh"
 	"github.com/mitchellh/multistep"
-	"github.com/mitchellh/packer/communicator/ssh"
+	"golang.org/x/crypto/ssh"
 )
 
 // sshAddress returns the ssh address.
@@ -15,18 +20,70 @@ func sshAddress(state multistep.StateBag) (string, error) {
 	return fmt.Sprintf("%s:%d", ipAddress, config.SSHPort), nil
 }
 
-// sshConfig returns the ssh configuration.
-func sshConfig(state multistep.StateBag) (*gossh.ClientConfig, error) {
+// loadSSHPrivateKey reads the unencrypted PEM RSA private key at path.
+func loadSSHPrivateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("not a PEM RSA private key")
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		return nil, errors.New("encrypted private keys are not supported")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// writeSSHKeyFile writes the temporary SSH private key to a file in the
+// working directory that only the user can read, and returns its path. The
+// key is only written once per build. A key from ssh_private_key_file is
+// already in a file, whose path is returned.
+func writeSSHKeyFile(state multistep.StateBag) (string, error) {
+	if path, ok := state.GetOk("ssh_key_file"); ok {
+		return path.(string), nil
+	}
+	config := state.Get("config").(config)
+	if config.SSHPrivateKeyFile != "" {
+		state.Put("ssh_key_file", config.SSHPrivateKeyFile)
+		return config.SSHPrivateKeyFile, nil
+	}
+	path := fmt.Sprintf("packer-googlecompute-%s.pem", state.Get("build_id").(string))
+	privateKey := state.Get("ssh_private_key").(string)
+	if err := ioutil.WriteFile(path, []byte(privateKey), 0600); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the permissions of an existing file.
+	if err := os.Chmod(path, 0600); err != nil {
+		return "", err
+	}
+	state.Put("ssh_key_file", path)
+	return path, nil
+}
+
+// sshCommand returns the ssh command that connects to the instance using
+// the private key at path.
+func sshCommand(state multistep.StateBag, path string) string {
+	config := state.Get("config").(config)
+	ipAddress := state.Get("instance_ip").(string)
+	return fmt.Sprintf("ssh -i %s -p %d %s@%s", path, config.SSHPort, config.SSHUsername, ipAddress)
+}
+
+// sshConfig returns the ssh configuration. The instance is new and its host
+// key unknown, so the host key is not verified.
+func sshConfig(state multistep.StateBag) (*ssh.ClientConfig, error) {
 	config := state.Get("config").(config)
 	privateKey := state.Get("ssh_private_key").(string)
 
-	keyring := new(ssh.SimpleKeychain)
-	if err := keyring.AddPEMKey(privateKey); err != nil {
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
 		return nil, fmt.Errorf("Error setting up SSH config: %s", err)
 	}
-	sshConfig := &gossh.ClientConfig{
-		User: config.SSHUsername,
-		Auth: []gossh.ClientAuth{gossh.ClientAuthKeyring(keyring)},
+	sshConfig := &ssh.ClientConfig{
+		User:            config.SSHUsername,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 	return sshConfig, nil
 }
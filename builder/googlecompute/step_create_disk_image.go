@@ -0,0 +1,56 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// stepCreateDiskImage represents a Packer build step that creates GCE machine
+// images from a persistent disk.
+type stepCreateDiskImage int
+
+// Run executes the Packer build step that creates a GCE machine image from
+// the instance's persistent boot disk.
+func (s *stepCreateDiskImage) Run(state multistep.StateBag) multistep.StepAction {
+	var (
+		client   = state.Get("client").(ComputeAPI)
+		config   = state.Get("config").(config)
+		diskName = state.Get("disk_name").(string)
+		ui       = state.Get("ui").(packer.Ui)
+		zone     = state.Get("zone").(string)
+	)
+	ui.Say("Creating image from disk...")
+	disk, err := client.GetDisk(zone, diskName)
+	if err != nil {
+		err := fmt.Errorf("Error creating image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	operation, err := client.CreateImageFromDisk(config.ImageName, config.ImageDescription, disk.SelfLink, buildLabels(state))
+	if err != nil {
+		err := fmt.Errorf("Error creating image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	ui.Say("Waiting for image to become available...")
+	err = waitForGlobalOperationState("DONE", operation.Name, client, config.stateTimeout, cancelChannel(state))
+	if err != nil {
+		err := fmt.Errorf("Error creating image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("image_name", config.ImageName)
+	return multistep.ActionContinue
+}
+
+// Cleanup.
+func (s *stepCreateDiskImage) Cleanup(state multistep.StateBag) {}
@@ -12,18 +12,20 @@ import (
 	"github.com/mitchellh/packer/packer"
 )
 
-// stepCreateImage represents a Packer build step that creates GCE machine
-// images.
+// stepCreateImage represents a Packer build step that bundles a GCE machine
+// image on the instance.
 type stepCreateImage int
 
-// Run executes the Packer build step that creates a GCE machine image.
+// Run executes the Packer build step that bundles the instance's root disk
+// into a tarball with the gcimagebundle command.
 //
-// Currently the only way to create a GCE image is to run the gcimagebundle
-// command on the running GCE instance.
+// The step is only used by the tarball image method, the default when
+// bucket_name is set; the tarball is then uploaded to the bucket and
+// registered as an image. The disk method, the default otherwise, creates
+// the image from the instance's boot disk with stepCreateDiskImage instead.
 func (s *stepCreateImage) Run(state multistep.StateBag) multistep.StepAction {
 	var (
 		config     = state.Get("config").(config)
-		comm       = state.Get("communicator").(packer.Communicator)
 		sudoPrefix = ""
 		ui         = state.Get("ui").(packer.Ui)
 	)
@@ -36,7 +38,7 @@ func (s *stepCreateImage) Run(state multistep.StateBag) multistep.StepAction {
 	cmd := new(packer.RemoteCmd)
 	cmd.Command = fmt.Sprintf("%s%s --output_file_name %s",
 		sudoPrefix, imageBundleCmd, imageFilename)
-	err := cmd.StartWithUi(comm, ui)
+	err := runRemoteCmd(state, cmd)
 	if err != nil {
 		err := fmt.Errorf("Error creating image: %s", err)
 		state.Put("error", err)
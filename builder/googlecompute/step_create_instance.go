@@ -5,23 +5,25 @@
 package googlecompute
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
-	"code.google.com/p/google-api-go-client/compute/v1beta16"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/common/uuid"
 	"github.com/mitchellh/packer/packer"
+	"google.golang.org/api/compute/v1"
 )
 
 // stepCreateInstance represents a Packer build step that creates GCE instances.
-type stepCreateInstance struct {
-	instanceName string
-}
+type stepCreateInstance int
 
-// Run executes the Packer build step that creates a GCE instance.
+// Run executes the Packer build step that creates a GCE instance. If the
+// zone is out of capacity or quota, the instance is created in the next of
+// the fallback zones instead.
 func (s *stepCreateInstance) Run(state multistep.StateBag) multistep.StepAction {
 	var (
-		client = state.Get("client").(*GoogleComputeClient)
+		client = state.Get("client").(ComputeAPI)
 		config = state.Get("config").(config)
 		ui     = state.Get("ui").(packer.Ui)
 	)
@@ -32,104 +34,338 @@ func (s *stepCreateInstance) Run(state multistep.StateBag) multistep.StepAction
 		Description: "New instance created by Packer",
 		Name:        name,
 	}
-	// Validate the zone.
-	zone, err := client.GetZone(config.Zone)
+	// Set the source image of the boot disk. Must be a fully-qualified URL.
+	var image *compute.Image
+	var err error
+	if config.SourceImageFamily != "" {
+		image, err = client.GetImageFromFamily(config.SourceImageFamily)
+	} else {
+		image, err = client.GetImage(config.SourceImage)
+	}
 	if err != nil {
 		err := fmt.Errorf("Error creating instance: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
-	// Set the source image. Must be a fully-qualified URL.
-	image, err := client.GetImage(config.SourceImage)
-	if err != nil {
-		err := fmt.Errorf("Error creating instance: %s", err)
+	if config.SourceImageFamily != "" {
+		ui.Message(fmt.Sprintf("Using image %s from family %s", image.Name, config.SourceImageFamily))
+	}
+	state.Put("source_image", image.SelfLink)
+	// The boot disk must be at least as large as the image. It defaults to
+	// the image's size.
+	if config.DiskSizeGb != 0 && config.DiskSizeGb < image.DiskSizeGb {
+		err := fmt.Errorf("Error creating instance: disk_size_gb is %dGB, but source image %s needs at least %dGB",
+			config.DiskSizeGb, image.Name, image.DiskSizeGb)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
-	instanceConfig.Image = image.SelfLink
-	// Set the machineType. Must be a fully-qualified URL.
-	machineType, err := client.GetMachineType(config.MachineType, zone.Name)
-	if err != nil {
+	// Set up the network. It belongs to the network project, which is the
+	// Shared VPC host project if there is one.
+	var network *compute.Network
+	if config.Network != "" {
+		network, err = client.GetNetwork(config.NetworkProjectId, config.Network)
+		if err != nil {
+			err := fmt.Errorf("Error creating instance: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	// Add the user metadata and the ssh key. Prepare rejects user metadata
+	// using the ssh key's name.
+	metadata := make(map[string]string)
+	for k, v := range config.Metadata {
+		metadata[k] = v
+	}
+	sshPublicKey := state.Get("ssh_public_key").(string)
+	metadata[sshKeysMetadataKey] = fmt.Sprintf("%s:%s", config.SSHUsername, sshPublicKey)
+	// Prepare checks the user metadata before the ssh key is known, so
+	// check the total again now that it is added.
+	if err := checkMetadataSize(metadata); err != nil {
 		err := fmt.Errorf("Error creating instance: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
-
 	}
-	instanceConfig.MachineType = machineType.SelfLink
-	// Set up the Network Interface.
-	network, err := client.GetNetwork(config.Network)
+	instanceConfig.Metadata = MapToMetadata(metadata)
+	// Add the network tags, e.g. for firewall rules.
+	if len(config.Tags) > 0 {
+		instanceConfig.Tags = SliceToTags(config.Tags)
+	}
+	// Label the instance and its boot disk with the build.
+	instanceConfig.Labels = buildLabels(state)
+	// Pin the CPU platform, e.g. Intel Skylake, if one is configured.
+	instanceConfig.MinCpuPlatform = config.MinCPUPlatform
+	// Preemptible instances are terminated instead of restarted, which Run
+	// handles by starting over with a new instance.
+	if config.Preemptible {
+		instanceConfig.Scheduling = NewPreemptibleScheduling()
+	}
+	// Add a service account so we can create an image of the machine and
+	// upload it to cloud storage, and so provisioners can call Google APIs.
+	if !config.DisableDefaultServiceAccount {
+		email := config.ServiceAccountEmail
+		if email == "" {
+			email = "default"
+		}
+		scopes := config.Scopes
+		if len(scopes) == 0 {
+			scopes = defaultInstanceScopes
+		}
+		serviceAccounts := []*compute.ServiceAccount{
+			NewServiceAccount(email, scopes),
+		}
+		instanceConfig.ServiceAccounts = serviceAccounts
+	}
+	// Create the instance in the first zone with capacity for it.
+	zones := append([]string{config.Zone}, config.FallbackZones...)
+	for i, zone := range zones {
+		if i > 0 {
+			ui.Say(fmt.Sprintf("Creating instance in fallback zone %s...", zone))
+		}
+		err = s.createInstance(state, zone, instanceConfig, image, network)
+		if err == nil || !isZoneCapacityError(err) || i == len(zones)-1 {
+			break
+		}
+		ui.Message(fmt.Sprintf("Zone %s is out of capacity: %s", zone, err))
+	}
 	if err != nil {
 		err := fmt.Errorf("Error creating instance: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
-	networkInterface := NewNetworkInterface(network, true)
+	return multistep.ActionContinue
+}
+
+// createInstance creates the instance described by instanceConfig in zone,
+// adding the zone-specific settings: the machine type, boot disk and
+// subnetwork. On success, the zone and names of the instance and of any
+// disk it leaves behind are put in state.
+func (s *stepCreateInstance) createInstance(state multistep.StateBag, zoneName string, instanceConfig *InstanceConfig, image *compute.Image, network *compute.Network) error {
+	var (
+		client = state.Get("client").(ComputeAPI)
+		config = state.Get("config").(config)
+		ui     = state.Get("ui").(packer.Ui)
+	)
+	// Work on a copy, as the settings differ between zones.
+	ic := *instanceConfig
+	// Validate the zone.
+	zone, err := client.GetZone(zoneName)
+	if err != nil {
+		return err
+	}
+	// The boot disk is kept when the instance is deleted if the image will
+	// be created from it.
+	autoDelete := config.ImageMethod != imageMethodDisk
+	bootDisk := NewBootDisk(ic.Name, image.SelfLink, autoDelete)
+	bootDisk.InitializeParams.DiskSizeGb = config.DiskSizeGb
+	bootDisk.InitializeParams.Labels = ic.Labels
+	bootDisk.InitializeParams.DiskType = fmt.Sprintf("%s/diskTypes/%s", zone.SelfLink, config.DiskType)
+	ic.Disks = []*compute.AttachedDisk{bootDisk}
+	// Set the machineType. Must be a fully-qualified URL. Custom machine
+	// types are not listed, so their URL is built from the zone's.
+	if config.CustomCPUs != 0 {
+		ic.MachineType = fmt.Sprintf("%s/machineTypes/%s", zone.SelfLink, customMachineType(config.CustomCPUs, config.CustomMemoryMb))
+	} else {
+		machineType, err := client.GetMachineType(config.MachineType, zone.Name)
+		if err != nil {
+			return err
+		}
+		ic.MachineType = machineType.SelfLink
+	}
+	// Set up the Network Interface. The subnetwork must be in the zone's
+	// region.
+	var subnetwork *compute.Subnetwork
+	if config.Subnetwork != "" {
+		region := zoneRegion(zone)
+		subnetwork, err = client.GetSubnetwork(config.NetworkProjectId, region, config.Subnetwork)
+		if err != nil {
+			return fmt.Errorf("subnetwork %s not found in region %s: %s", config.Subnetwork, region, err)
+		}
+		if network == nil {
+			// The network is the one the subnetwork belongs to.
+			network = &compute.Network{SelfLink: subnetwork.Network}
+		} else if subnetwork.Network != network.SelfLink {
+			return fmt.Errorf("subnetwork %s is not in network %s", config.Subnetwork, config.Network)
+		}
+	}
+	networkInterface := NewNetworkInterface(network, !config.OmitExternalIP)
+	if subnetwork != nil {
+		networkInterface.Subnetwork = subnetwork.SelfLink
+	}
 	networkInterfaces := []*compute.NetworkInterface{
 		networkInterface,
 	}
-	instanceConfig.NetworkInterfaces = networkInterfaces
-	// Add the metadata, which also setups up the ssh key.
-	metadata := make(map[string]string)
-	sshPublicKey := state.Get("ssh_public_key").(string)
-	metadata["sshKeys"] = fmt.Sprintf("%s:%s", config.SSHUsername, sshPublicKey)
-	instanceConfig.Metadata = MapToMetadata(metadata)
-	// Add the default service so we can create an image of the machine and
-	// upload it to cloud storage.
-	defaultServiceAccount := NewServiceAccount("default")
-	serviceAccounts := []*compute.ServiceAccount{
-		defaultServiceAccount,
-	}
-	instanceConfig.ServiceAccounts = serviceAccounts
+	ic.NetworkInterfaces = networkInterfaces
 	// Create the instance based on configuration
-	operation, err := client.CreateInstance(zone.Name, instanceConfig)
+	operation, err := client.CreateInstance(zone.Name, &ic)
 	if err != nil {
-		err := fmt.Errorf("Error creating instance: %s", err)
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+		return err
+	}
+	// Update the state now, so that Cleanup destroys the instance even if
+	// the build is cancelled while it is being created.
+	state.Put("zone", zone.Name)
+	state.Put("instance_name", ic.Name)
+	state.Put("instance_url", fmt.Sprintf("%s/instances/%s", zone.SelfLink, ic.Name))
+	if !autoDelete {
+		state.Put("disk_name", ic.Name)
+		state.Put("disk_url", fmt.Sprintf("%s/disks/%s", zone.SelfLink, ic.Name))
 	}
 	ui.Say("Waiting for the instance to be created...")
-	err = waitForZoneOperationState("DONE", config.Zone, operation.Name, client, config.stateTimeout)
-	if err != nil {
-		err := fmt.Errorf("Error creating instance: %s", err)
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+	err = waitForZoneOperationState("DONE", zone.Name, operation.Name, client, config.stateTimeout, cancelChannel(state))
+	if _, ok := err.(*OperationError); ok {
+		// The operation failed, so there is nothing to clean up.
+		state.Put("instance_name", "")
+		state.Put("disk_name", "")
 	}
-	// Update the state.
-	state.Put("instance_name", name)
-	s.instanceName = name
-	return multistep.ActionContinue
+	return err
 }
 
-// Cleanup destroys the GCE instance created during the image creation process.
+// Cleanup destroys the GCE instance created during the image creation
+// process, followed by its boot disk if that was kept. Resources that cannot
+// be destroyed are added to the leak report. If the build failed and
+// on_error is keep, they are left in place for debugging instead.
 func (s *stepCreateInstance) Cleanup(state multistep.StateBag) {
 	var (
-		client = state.Get("client").(*GoogleComputeClient)
+		client = cleanupClient(state)
 		config = state.Get("config").(config)
 		ui     = state.Get("ui").(packer.Ui)
 	)
-	if s.instanceName == "" {
+	// Nothing was created unless the zone is known.
+	rawZone, ok := state.GetOk("zone")
+	if !ok {
+		return
+	}
+	zone := rawZone.(string)
+	instanceName, _ := state.Get("instance_name").(string)
+	diskName, _ := state.Get("disk_name").(string)
+	if instanceName == "" && diskName == "" {
 		return
 	}
-	ui.Say("Destroying instance...")
-	operation, err := client.DeleteInstance(config.Zone, s.instanceName)
+	_, failed := state.GetOk("error")
+	// A preemptible instance that stopped while the build failed was most
+	// likely preempted.
+	if instanceName != "" && failed && config.Preemptible {
+		status, err := client.InstanceStatus(zone, instanceName)
+		if err == nil && (status == "STOPPING" || status == "TERMINATED") {
+			ui.Say("The instance was preempted.")
+			state.Put("instance_preempted", true)
+		}
+	}
+	// Cancelled builds and preempted instances are always cleaned up.
+	_, preempted := state.GetOk("instance_preempted")
+	if failed && config.OnError == onErrorKeep && !preempted && !buildCancelled(state) {
+		s.keep(state, zone, instanceName, diskName)
+		return
+	}
+	if instanceName != "" {
+		ui.Say("Destroying instance...")
+		err := destroyInstance(client, zone, instanceName, config.stateTimeout)
+		if err != nil {
+			reportLeak(state, state.Get("instance_url").(string), err)
+		}
+	}
+	if diskName == "" {
+		return
+	}
+	ui.Say("Destroying boot disk...")
+	err := destroyDisk(client, zone, diskName, config.stateTimeout)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Error destroying instance. Please destroy it manually: %v", s.instanceName))
+		reportLeak(state, state.Get("disk_url").(string), err)
 	}
-	ui.Say("Waiting for the instance to be deleted...")
-	for {
-		status, err := client.ZoneOperationStatus(config.Zone, operation.Name)
+}
+
+// keep leaves the instance and the boot disk, if any, in place after a
+// failed build, and tells the user how to reach them. They are added to the
+// leak report, and their build labels let the reaper find them.
+func (s *stepCreateInstance) keep(state multistep.StateBag, zone, instanceName, diskName string) {
+	var (
+		config = state.Get("config").(config)
+		ui     = state.Get("ui").(packer.Ui)
+	)
+	ui.Say("Keeping the instance for debugging, as on_error is keep. Please destroy it when done.")
+	var urls []string
+	if instanceName != "" {
+		ui.Message(fmt.Sprintf("Instance: %s", instanceName))
+		urls = append(urls, state.Get("instance_url").(string))
+	}
+	if diskName != "" {
+		ui.Message(fmt.Sprintf("Boot disk: %s", diskName))
+		urls = append(urls, state.Get("disk_url").(string))
+	}
+	ui.Message(fmt.Sprintf("Zone: %s", zone))
+	if instanceName != "" {
+		path, err := writeSSHKeyFile(state)
 		if err != nil {
-			ui.Error(fmt.Sprintf("Error destroying instance. Please destroy it manually: %v", s.instanceName))
+			ui.Error(fmt.Sprintf("Error writing the SSH private key: %s", err))
+		} else {
+			ui.Message(fmt.Sprintf("SSH private key: %s", path))
 		}
-		if status == "DONE" {
-			break
+		if ip, ok := state.GetOk("instance_ip"); ok {
+			ui.Message(fmt.Sprintf("IP address: %s", ip))
+			if err == nil {
+				ui.Message(fmt.Sprintf("Connect with: %s", sshCommand(state, path)))
+			}
+		}
+	}
+	// The key is needed to reach the instance, so it is not removed.
+	state.Put("instance_kept", true)
+	for _, url := range urls {
+		if err := appendLeakReport(config.LeakReportFile, url); err != nil {
+			ui.Error(fmt.Sprintf("Error writing the leak report %s: %s", config.LeakReportFile, err))
+			return
+		}
+	}
+	ui.Message(fmt.Sprintf("Recorded in the leak report %s", config.LeakReportFile))
+}
+
+// destroyInstance deletes the named instance and checks that it is gone,
+// waiting up to timeout. An instance that does not exist is already
+// destroyed.
+func destroyInstance(client ComputeAPI, zone, name string, timeout time.Duration) error {
+	operation, err := client.DeleteInstance(zone, name)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Cleanup also runs when the build is cancelled, so the wait is not.
+	err = waitForZoneOperationState("DONE", zone, operation.Name, client, timeout, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := client.InstanceStatus(zone, name); !isNotFound(err) {
+		if err == nil {
+			err = errors.New("the instance still exists")
+		}
+		return err
+	}
+	return nil
+}
+
+// destroyDisk deletes the named disk and checks that it is gone, waiting up
+// to timeout. A disk that does not exist is already destroyed.
+func destroyDisk(client ComputeAPI, zone, name string, timeout time.Duration) error {
+	operation, err := client.DeleteDisk(zone, name)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = waitForZoneOperationState("DONE", zone, operation.Name, client, timeout, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := client.GetDisk(zone, name); !isNotFound(err) {
+		if err == nil {
+			err = errors.New("the disk still exists")
 		}
+		return err
 	}
-	return
+	return nil
 }
@@ -0,0 +1,455 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	"google.golang.org/api/compute/v1"
+)
+
+var errTest = errors.New("test error")
+
+func TestStepCreateInstance_disk(t *testing.T) {
+	b := testBuilder(t, testConfig())
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, b, client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	name := state.Get("instance_name").(string)
+	instance, ok := client.Instances[name]
+	if !ok {
+		t.Fatalf("instance %s was not created", name)
+	}
+	if len(instance.Disks) != 1 || !instance.Disks[0].Boot || instance.Disks[0].AutoDelete {
+		t.Fatalf("the boot disk should be kept: %#v", instance.Disks)
+	}
+	disk, ok := client.Disks[state.Get("disk_name").(string)]
+	if !ok || disk.SourceImage != client.Images["debian-7-wheezy-v20131014"].SelfLink {
+		t.Fatalf("bad boot disk: %#v", disk)
+	}
+	if len(instance.ServiceAccounts) != 1 || instance.ServiceAccounts[0].Email != "default" {
+		t.Fatalf("the default service account should be attached: %#v", instance.ServiceAccounts)
+	}
+	for _, labels := range []map[string]string{instance.Labels, disk.Labels} {
+		if buildId, created, ok := parseBuildLabels(labels); !ok || buildId != "test-build" || time.Since(created) > time.Minute {
+			t.Fatalf("bad labels: %v", labels)
+		}
+	}
+
+	step.Cleanup(state)
+	if len(client.Instances) != 0 || len(client.Disks) != 0 {
+		t.Fatalf("resources left behind: %v %v", client.Instances, client.Disks)
+	}
+}
+
+func TestStepCreateInstance_imageFamily(t *testing.T) {
+	raw := testConfig()
+	delete(raw, "source_image")
+	raw["source_image_family"] = "debian-7"
+	b := testBuilder(t, raw)
+	client := NewFakeComputeAPI("hashicorp")
+	client.Images["debian-7-wheezy-v20131014"].Family = "debian-7"
+	state := testState(t, b, client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	selfLink := client.Images["debian-7-wheezy-v20131014"].SelfLink
+	if state.Get("source_image").(string) != selfLink {
+		t.Fatalf("bad source_image: %s", state.Get("source_image"))
+	}
+	if disk := client.Disks[state.Get("disk_name").(string)]; disk.SourceImage != selfLink {
+		t.Fatalf("bad boot disk: %#v", disk)
+	}
+	step.Cleanup(state)
+}
+
+func TestStepCreateInstance_metadataAndTags(t *testing.T) {
+	raw := testConfig()
+	raw["metadata"] = map[string]string{"startup-script": "echo hello"}
+	raw["tags"] = []string{"packer", "allow-ssh"}
+	b := testBuilder(t, raw)
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, b, client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	instance := client.Instances[state.Get("instance_name").(string)]
+	metadata := make(map[string]string)
+	for _, item := range instance.Metadata.Items {
+		metadata[item.Key] = *item.Value
+	}
+	if len(metadata) != 2 || metadata["startup-script"] != "echo hello" || metadata["sshKeys"] != "root:ssh-rsa AAAA" {
+		t.Fatalf("bad metadata: %v", metadata)
+	}
+	if instance.Tags == nil || len(instance.Tags.Items) != 2 || instance.Tags.Items[1] != "allow-ssh" {
+		t.Fatalf("bad tags: %#v", instance.Tags)
+	}
+	step.Cleanup(state)
+}
+
+func TestStepCreateInstance_metadataSize(t *testing.T) {
+	// The user metadata is within the limit until the ssh key is added.
+	value := strings.Repeat("x", maxMetadataValueSize-len("a"))
+	raw := testConfig()
+	raw["metadata"] = map[string]string{"a": value, "b": value[:len(value)-1]}
+	b := testBuilder(t, raw)
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, b, client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if err, ok := state.GetOk("error"); !ok || !strings.Contains(err.(error).Error(), "in total") {
+		t.Fatalf("expected a metadata size error, got: %v", err)
+	}
+	if len(client.Instances) != 0 {
+		t.Fatalf("no instance should be created: %v", client.Instances)
+	}
+	step.Cleanup(state)
+}
+
+func TestStepCreateInstance_subnetwork(t *testing.T) {
+	raw := testConfig()
+	delete(raw, "network")
+	raw["subnetwork"] = "build"
+	b := testBuilder(t, raw)
+	client := NewFakeComputeAPI("hashicorp")
+	client.Subnetworks["us-central1/build"] = &compute.Subnetwork{
+		Name:     "build",
+		Network:  client.Networks["default"].SelfLink,
+		SelfLink: client.link("regions/us-central1/subnetworks/build"),
+	}
+	state := testState(t, b, client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	ni := client.Instances[state.Get("instance_name").(string)].NetworkInterfaces[0]
+	if ni.Network != client.Networks["default"].SelfLink || ni.Subnetwork != client.Subnetworks["us-central1/build"].SelfLink {
+		t.Fatalf("bad network interface: %#v", ni)
+	}
+	step.Cleanup(state)
+
+	// The subnetwork must be in the network.
+	client.Networks["other"] = &compute.Network{Name: "other", SelfLink: client.link("global/networks/other")}
+	raw["network"] = "other"
+	state = testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	// The subnetwork must be in the zone's region.
+	delete(client.Subnetworks, "us-central1/build")
+	client.Subnetworks["europe-west1/build"] = &compute.Subnetwork{Name: "build"}
+	delete(raw, "network")
+	state = testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(client.Instances) != 0 {
+		t.Fatalf("no instance should be created: %v", client.Instances)
+	}
+}
+
+func TestStepCreateInstance_bootDisk(t *testing.T) {
+	raw := testConfig()
+	raw["disk_size_gb"] = 50
+	raw["disk_type"] = "pd-ssd"
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	disk := client.Disks[state.Get("disk_name").(string)]
+	if disk.SizeGb != 50 || disk.Type != client.Zones["us-central1-a"].SelfLink+"/diskTypes/pd-ssd" {
+		t.Fatalf("bad boot disk: %#v", disk)
+	}
+	step.Cleanup(state)
+
+	// The disk cannot be smaller than the image.
+	raw["disk_size_gb"] = 5
+	state = testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(client.Instances) != 0 {
+		t.Fatalf("no instance should be created: %v", client.Instances)
+	}
+}
+
+func TestStepCreateInstance_customMachineType(t *testing.T) {
+	raw := testConfig()
+	raw["custom_cpus"] = 16
+	raw["custom_memory_mb"] = 14848
+	raw["min_cpu_platform"] = "Intel Skylake"
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	instance := client.Instances[state.Get("instance_name").(string)]
+	if instance.MachineType != client.Zones["us-central1-a"].SelfLink+"/machineTypes/custom-16-14848" {
+		t.Fatalf("bad machine type: %s", instance.MachineType)
+	}
+	if instance.MinCpuPlatform != "Intel Skylake" {
+		t.Fatalf("bad min cpu platform: %s", instance.MinCpuPlatform)
+	}
+	step.Cleanup(state)
+}
+
+func TestStepCreateInstance_serviceAccount(t *testing.T) {
+	raw := testConfig()
+	raw["service_account_email"] = "builder@hashicorp.iam.gserviceaccount.com"
+	raw["scopes"] = []string{"cloud-platform"}
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	instance := client.Instances[state.Get("instance_name").(string)]
+	if len(instance.ServiceAccounts) != 1 {
+		t.Fatalf("bad service accounts: %#v", instance.ServiceAccounts)
+	}
+	sa := instance.ServiceAccounts[0]
+	if sa.Email != "builder@hashicorp.iam.gserviceaccount.com" || len(sa.Scopes) != 1 || sa.Scopes[0] != "https://www.googleapis.com/auth/cloud-platform" {
+		t.Fatalf("bad service account: %#v", sa)
+	}
+	step.Cleanup(state)
+}
+
+func TestStepCreateInstance_disableDefaultServiceAccount(t *testing.T) {
+	raw := testConfig()
+	raw["disable_default_service_account"] = true
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	instance := client.Instances[state.Get("instance_name").(string)]
+	if len(instance.ServiceAccounts) != 0 {
+		t.Fatalf("no service account should be attached: %#v", instance.ServiceAccounts)
+	}
+	step.Cleanup(state)
+}
+
+func TestStepCreateInstance_cleanupLeak(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	raw := testConfig()
+	raw["leak_report_file"] = filepath.Join(dir, "leaks.txt")
+	raw["state_timeout"] = "100ms"
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	// The instance cannot be deleted and the disk deletion times out.
+	client.Errors["DeleteInstance"] = errTest
+	client.OperationPolls = 1000
+	step.Cleanup(state)
+
+	zone := client.Zones["us-central1-a"].SelfLink
+	name := state.Get("instance_name").(string)
+	leaks := zone + "/instances/" + name + "\n" + zone + "/disks/" + name + "\n"
+	report, err := ioutil.ReadFile(raw["leak_report_file"].(string))
+	if err != nil || string(report) != leaks {
+		t.Fatalf("bad leak report: %q (err: %v)", report, err)
+	}
+	output := state.Get("ui").(*packer.BasicUi).Writer.(*bytes.Buffer).String()
+	if !strings.Contains(output, zone+"/instances/"+name+": test error") || !strings.Contains(output, "Timeout") {
+		t.Fatalf("bad output: %s", output)
+	}
+}
+
+func TestStepCreateInstance_cleanupDeleted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	raw := testConfig()
+	raw["leak_report_file"] = filepath.Join(dir, "leaks.txt")
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	// Resources that are already gone are not leaks.
+	delete(client.Instances, state.Get("instance_name").(string))
+	delete(client.Disks, state.Get("disk_name").(string))
+	step.Cleanup(state)
+	if _, err := os.Stat(raw["leak_report_file"].(string)); !os.IsNotExist(err) {
+		t.Fatalf("no leak report should be written: %v", err)
+	}
+}
+
+func TestStepCreateInstance_onErrorKeep(t *testing.T) {
+	defer testChdir(t)()
+
+	raw := testConfig()
+	raw["on_error"] = "keep"
+	raw["ssh_username"] = "packer"
+	b := testBuilder(t, raw)
+	client := NewFakeComputeAPI("hashicorp")
+	// run creates an instance and cleans up after a build that ended with
+	// the state values in end.
+	run := func(state multistep.StateBag, end map[string]interface{}) {
+		state.Put("ssh_public_key", "ssh-rsa AAAA")
+		state.Put("ssh_private_key", "PRIVATE KEY")
+		step := new(stepCreateInstance)
+		if action := step.Run(state); action != multistep.ActionContinue {
+			t.Fatalf("bad action: %#v", action)
+		}
+		state.Put("instance_ip", "192.0.2.1")
+		for k, v := range end {
+			state.Put(k, v)
+		}
+		step.Cleanup(state)
+	}
+
+	// Successful builds clean up.
+	state := testState(t, b, client)
+	run(state, nil)
+	if len(client.Instances) != 0 || len(client.Disks) != 0 {
+		t.Fatalf("resources left behind: %v %v", client.Instances, client.Disks)
+	}
+
+	// Cancelled builds clean up.
+	cancel := make(chan struct{})
+	close(cancel)
+	state = testState(t, b, client)
+	run(state, map[string]interface{}{
+		"cancel": (<-chan struct{})(cancel),
+		"error":  errCancelled,
+	})
+	if len(client.Instances) != 0 || len(client.Disks) != 0 {
+		t.Fatalf("resources left behind: %v %v", client.Instances, client.Disks)
+	}
+
+	// Failed builds keep the instance and its disk.
+	state = testState(t, b, client)
+	run(state, map[string]interface{}{"error": errTest})
+	name := state.Get("instance_name").(string)
+	if _, ok := client.Instances[name]; !ok || len(client.Disks) != 1 {
+		t.Fatalf("the instance and disk should be kept: %v %v", client.Instances, client.Disks)
+	}
+	keyFile := "packer-googlecompute-test-build.pem"
+	info, err := os.Stat(keyFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("bad key file: %v %v", info, err)
+	}
+	output := state.Get("ui").(*packer.BasicUi).Writer.(*bytes.Buffer).String()
+	for _, s := range []string{name, "us-central1-a", "ssh -i " + keyFile + " -p 22 packer@192.0.2.1"} {
+		if !strings.Contains(output, s) {
+			t.Fatalf("output should contain %q: %s", s, output)
+		}
+	}
+	report, err := ioutil.ReadFile(b.config.LeakReportFile)
+	zone := client.Zones["us-central1-a"].SelfLink
+	if err != nil || string(report) != zone+"/instances/"+name+"\n"+zone+"/disks/"+name+"\n" {
+		t.Fatalf("bad leak report: %q (err: %v)", report, err)
+	}
+}
+
+func TestStepCreateInstance_tarball(t *testing.T) {
+	raw := testConfig()
+	raw["image_method"] = imageMethodTarball
+	raw["bucket_name"] = "packer-images"
+	b := testBuilder(t, raw)
+	client := NewFakeComputeAPI("hashicorp")
+	state := testState(t, b, client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	instance := client.Instances[state.Get("instance_name").(string)]
+	if len(instance.Disks) != 1 || !instance.Disks[0].AutoDelete {
+		t.Fatalf("the boot disk should be deleted with the instance: %#v", instance.Disks)
+	}
+	if _, ok := state.GetOk("disk_name"); ok {
+		t.Fatal("disk_name should not be set")
+	}
+	if len(instance.ServiceAccounts) != 1 {
+		t.Fatalf("the default service account should be attached: %#v", instance.ServiceAccounts)
+	}
+
+	step.Cleanup(state)
+	if len(client.Instances) != 0 || len(client.Disks) != 0 {
+		t.Fatalf("resources left behind: %v %v", client.Instances, client.Disks)
+	}
+}
+
+func TestStepCreateInstance_operationError(t *testing.T) {
+	b := testBuilder(t, testConfig())
+	client := NewFakeComputeAPI("hashicorp")
+	client.OperationErrors["CreateInstance"] = errTest
+	state := testState(t, b, client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+
+	step := new(stepCreateInstance)
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+	if name, ok := state.GetOk("instance_name"); ok && name.(string) != "" {
+		t.Fatal("instance_name should not be set")
+	}
+	step.Cleanup(state)
+	if len(client.Instances) != 0 || len(client.Disks) != 0 {
+		t.Fatalf("resources left behind: %v %v", client.Instances, client.Disks)
+	}
+}
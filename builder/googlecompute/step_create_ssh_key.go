@@ -10,27 +10,45 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"os"
 
-	"code.google.com/p/go.crypto/ssh"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
+	"golang.org/x/crypto/ssh"
 )
 
 // stepCreateSSHKey represents a Packer build step that generates SSH key pairs.
 type stepCreateSSHKey int
 
-// Run executes the Packer build step that generates SSH key pairs.
+// Run executes the Packer build step that generates SSH key pairs. A key
+// from ssh_private_key_file is used instead of a generated one. In debug mode
+// the private key is written to a file so that the instance can be reached
+// while the build is paused.
 func (s *stepCreateSSHKey) Run(state multistep.StateBag) multistep.StepAction {
 	var (
-		ui = state.Get("ui").(packer.Ui)
+		config = state.Get("config").(config)
+		ui     = state.Get("ui").(packer.Ui)
 	)
-	ui.Say("Creating temporary ssh key for instance...")
-	priv, err := rsa.GenerateKey(rand.Reader, 2014)
-	if err != nil {
-		err := fmt.Errorf("Error creating temporary ssh key: %s", err)
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+	var priv *rsa.PrivateKey
+	var err error
+	if config.SSHPrivateKeyFile != "" {
+		ui.Say("Using ssh key from ssh_private_key_file...")
+		priv, err = loadSSHPrivateKey(config.SSHPrivateKeyFile)
+		if err != nil {
+			err := fmt.Errorf("Error loading ssh key: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	} else {
+		ui.Say("Creating temporary ssh key for instance...")
+		priv, err = rsa.GenerateKey(rand.Reader, 2014)
+		if err != nil {
+			err := fmt.Errorf("Error creating temporary ssh key: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
 	}
 	priv_der := x509.MarshalPKCS1PrivateKey(priv)
 	priv_blk := pem.Block{
@@ -47,9 +65,33 @@ func (s *stepCreateSSHKey) Run(state multistep.StateBag) multistep.StepAction {
 	}
 	state.Put("ssh_private_key", string(pem.EncodeToMemory(&priv_blk)))
 	state.Put("ssh_public_key", string(ssh.MarshalAuthorizedKey(pub)))
+	if config.PackerDebug {
+		path, err := writeSSHKeyFile(state)
+		if err != nil {
+			err := fmt.Errorf("Error saving debug ssh key: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		ui.Message(fmt.Sprintf("Saved ssh private key for debugging: %s", path))
+	}
 	return multistep.ActionContinue
 }
 
-// Cleanup.
-// Nothing to clean up. SSH keys are associated with a single GCE instance.
-func (s *stepCreateSSHKey) Cleanup(state multistep.StateBag) {}
+// Cleanup removes the private key file written for debugging, unless it is
+// the user's own key or the instance was kept for debugging.
+// SSH keys are otherwise associated with a single GCE instance.
+func (s *stepCreateSSHKey) Cleanup(state multistep.StateBag) {
+	config := state.Get("config").(config)
+	path, ok := state.GetOk("ssh_key_file")
+	if !ok || config.SSHPrivateKeyFile != "" {
+		return
+	}
+	if _, ok := state.GetOk("instance_kept"); ok {
+		return
+	}
+	ui := state.Get("ui").(packer.Ui)
+	if err := os.Remove(path.(string)); err != nil && !os.IsNotExist(err) {
+		ui.Error(fmt.Sprintf("Error removing ssh key file %s: %s", path, err))
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+// testChdir changes into a new temporary directory and returns a function
+// that changes back and removes it.
+func testChdir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+// testSSHKeyFile writes a new RSA private key to a file and returns its path.
+func testSSHKeyFile(t *testing.T) string {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	path, err := filepath.Abs("id_rsa")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return path
+}
+
+func TestStepCreateSSHKey_debug(t *testing.T) {
+	defer testChdir(t)()
+
+	raw := testConfig()
+	raw["packer_debug"] = true
+	raw["ssh_username"] = "packer"
+	state := testState(t, testBuilder(t, raw), NewFakeComputeAPI("hashicorp"))
+	step := new(stepCreateSSHKey)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	path := state.Get("ssh_key_file").(string)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("bad key file mode: %s", fi.Mode())
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(b) != state.Get("ssh_private_key").(string) {
+		t.Fatal("the key file should hold the private key")
+	}
+
+	state.Put("instance_ip", "192.0.2.1")
+	want := "ssh -i " + path + " -p 22 packer@192.0.2.1"
+	if cmd := sshCommand(state, path); cmd != want {
+		t.Fatalf("bad ssh command: %s", cmd)
+	}
+
+	step.Cleanup(state)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the key file should be removed: %v", err)
+	}
+}
+
+func TestStepCreateSSHKey_noDebug(t *testing.T) {
+	defer testChdir(t)()
+
+	state := testState(t, testBuilder(t, testConfig()), NewFakeComputeAPI("hashicorp"))
+	step := new(stepCreateSSHKey)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("ssh_key_file"); ok {
+		t.Fatal("the key should only be written in debug mode")
+	}
+	sshConfig, err := sshConfig(state)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if sshConfig.User != "root" || len(sshConfig.Auth) != 1 {
+		t.Fatalf("bad ssh config: %#v", sshConfig)
+	}
+	step.Cleanup(state)
+}
+
+func TestStepCreateSSHKey_privateKeyFile(t *testing.T) {
+	defer testChdir(t)()
+
+	raw := testConfig()
+	raw["packer_debug"] = true
+	raw["ssh_private_key_file"] = testSSHKeyFile(t)
+	state := testState(t, testBuilder(t, raw), NewFakeComputeAPI("hashicorp"))
+	step := new(stepCreateSSHKey)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	path := state.Get("ssh_key_file").(string)
+	if path != raw["ssh_private_key_file"] {
+		t.Fatalf("the user's key file should be used, got %s", path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(b) != state.Get("ssh_private_key").(string) {
+		t.Fatal("the user's key should be used")
+	}
+
+	step.Cleanup(state)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("the user's key file should not be removed: %s", err)
+	}
+}
+
+func TestStepCreateSSHKey_kept(t *testing.T) {
+	defer testChdir(t)()
+
+	raw := testConfig()
+	raw["packer_debug"] = true
+	state := testState(t, testBuilder(t, raw), NewFakeComputeAPI("hashicorp"))
+	step := new(stepCreateSSHKey)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	state.Put("instance_kept", true)
+	step.Cleanup(state)
+	if _, err := os.Stat(state.Get("ssh_key_file").(string)); err != nil {
+		t.Fatalf("the key of a kept instance should not be removed: %s", err)
+	}
+}
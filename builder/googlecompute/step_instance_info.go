@@ -17,28 +17,53 @@ type stepInstanceInfo int
 // Run executes the Packer build step that gathers GCE instance info.
 func (s *stepInstanceInfo) Run(state multistep.StateBag) multistep.StepAction {
 	var (
-		client = state.Get("client").(*GoogleComputeClient)
+		client = state.Get("client").(ComputeAPI)
 		config = state.Get("config").(config)
 		ui     = state.Get("ui").(packer.Ui)
 	)
 	instanceName := state.Get("instance_name").(string)
-	err := waitForInstanceState("RUNNING", config.Zone, instanceName, client, config.stateTimeout)
+	zone := state.Get("zone").(string)
+	err := waitForInstanceState("RUNNING", zone, instanceName, client, config.stateTimeout, cancelChannel(state))
 	if err != nil {
 		err := fmt.Errorf("Error creating instance: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
-	ip, err := client.GetNatIP(config.Zone, instanceName)
+	if config.UseInternalIP {
+		ip, err := client.GetInternalIP(zone, instanceName)
+		if err != nil {
+			err := fmt.Errorf("Error retrieving instance internal ip address: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		state.Put("instance_ip", ip)
+		s.debugMessage(state)
+		return multistep.ActionContinue
+	}
+	ip, err := client.GetNatIP(zone, instanceName)
 	if err != nil {
-		err := fmt.Errorf("Error retrieving instance nat ip address: %s", err)
+		err := fmt.Errorf("Error retrieving instance nat ip address: %s. Set use_internal_ip to connect over the instance's internal IP address instead.", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 	state.Put("instance_ip", ip)
+	s.debugMessage(state)
 	return multistep.ActionContinue
 }
 
+// debugMessage prints the ssh command that connects to the instance while a
+// debug build is paused.
+func (s *stepInstanceInfo) debugMessage(state multistep.StateBag) {
+	path, ok := state.GetOk("ssh_key_file")
+	if !ok || !state.Get("config").(config).PackerDebug {
+		return
+	}
+	ui := state.Get("ui").(packer.Ui)
+	ui.Message(fmt.Sprintf("Connect with: %s", sshCommand(state, path.(string))))
+}
+
 // Cleanup.
 func (s *stepInstanceInfo) Cleanup(state multistep.StateBag) {}
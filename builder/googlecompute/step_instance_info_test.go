@@ -0,0 +1,86 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+// testInstanceState runs stepCreateInstance against client and returns the
+// resulting state.
+func testInstanceState(t *testing.T, raw map[string]interface{}, client *FakeComputeAPI) multistep.StateBag {
+	state := testState(t, testBuilder(t, raw), client)
+	state.Put("ssh_public_key", "ssh-rsa AAAA")
+	if action := new(stepCreateInstance).Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	return state
+}
+
+func TestStepInstanceInfo_natIP(t *testing.T) {
+	client := NewFakeComputeAPI("hashicorp")
+	state := testInstanceState(t, testConfig(), client)
+
+	step := new(stepInstanceInfo)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if ip := state.Get("instance_ip").(string); !strings.HasPrefix(ip, "192.0.2.") {
+		t.Fatalf("expected the NAT IP, got %s", ip)
+	}
+}
+
+func TestStepInstanceInfo_internalIP(t *testing.T) {
+	raw := testConfig()
+	raw["omit_external_ip"] = true
+	raw["use_internal_ip"] = true
+	client := NewFakeComputeAPI("hashicorp")
+	state := testInstanceState(t, raw, client)
+	instance := client.Instances[state.Get("instance_name").(string)]
+	if len(instance.NetworkInterfaces[0].AccessConfigs) != 0 {
+		t.Fatalf("no access config should be attached: %#v", instance.NetworkInterfaces[0].AccessConfigs)
+	}
+
+	step := new(stepInstanceInfo)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if ip := state.Get("instance_ip").(string); !strings.HasPrefix(ip, "10.240.0.") {
+		t.Fatalf("expected the internal IP, got %s", ip)
+	}
+}
+
+func TestStepInstanceInfo_noNatIP(t *testing.T) {
+	client := NewFakeComputeAPI("hashicorp")
+	state := testInstanceState(t, testConfig(), client)
+	instance := client.Instances[state.Get("instance_name").(string)]
+	instance.NetworkInterfaces[0].AccessConfigs = nil
+
+	step := new(stepInstanceInfo)
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	err := state.Get("error").(error)
+	if !strings.Contains(err.Error(), "no external IP") || !strings.Contains(err.Error(), "use_internal_ip") {
+		t.Fatalf("error should explain the missing NAT IP: %s", err)
+	}
+}
+
+func TestStepInstanceInfo_terminated(t *testing.T) {
+	client := NewFakeComputeAPI("hashicorp")
+	state := testInstanceState(t, testConfig(), client)
+	client.Instances[state.Get("instance_name").(string)].Status = "TERMINATED"
+
+	step := new(stepInstanceInfo)
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if err := state.Get("error").(error); !strings.Contains(err.Error(), "terminated") {
+		t.Fatalf("bad error: %s", err)
+	}
+}
@@ -17,13 +17,13 @@ type stepRegisterImage int
 // Run executes the Packer build step that registers a GCE machine image.
 func (s *stepRegisterImage) Run(state multistep.StateBag) multistep.StepAction {
 	var (
-		client = state.Get("client").(*GoogleComputeClient)
+		client = state.Get("client").(ComputeAPI)
 		config = state.Get("config").(config)
 		ui     = state.Get("ui").(packer.Ui)
 	)
 	ui.Say("Adding image to the project...")
 	imageURL := fmt.Sprintf("https://storage.cloud.google.com/%s/%s.tar.gz", config.BucketName, config.ImageName)
-	operation, err := client.CreateImage(config.ImageName, config.ImageDescription, imageURL)
+	operation, err := client.CreateImage(config.ImageName, config.ImageDescription, imageURL, buildLabels(state))
 	if err != nil {
 		err := fmt.Errorf("Error creating image: %s", err)
 		state.Put("error", err)
@@ -31,7 +31,7 @@ func (s *stepRegisterImage) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 	ui.Say("Waiting for image to become available...")
-	err = waitForGlobalOperationState("DONE", operation.Name, client, config.stateTimeout)
+	err = waitForGlobalOperationState("DONE", operation.Name, client, config.stateTimeout, cancelChannel(state))
 	if err != nil {
 		err := fmt.Errorf("Error creating image: %s", err)
 		state.Put("error", err)
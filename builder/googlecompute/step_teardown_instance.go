@@ -0,0 +1,54 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// stepTeardownInstance represents a Packer build step that deletes the GCE
+// instance while leaving its persistent boot disk in place.
+type stepTeardownInstance int
+
+// Run executes the Packer build step that deletes the GCE instance.
+//
+// A persistent disk can only be turned into an image once it is no longer
+// attached to a running instance. Deleting the instance does not delete the
+// boot disk.
+func (s *stepTeardownInstance) Run(state multistep.StateBag) multistep.StepAction {
+	var (
+		client = state.Get("client").(ComputeAPI)
+		config = state.Get("config").(config)
+		ui     = state.Get("ui").(packer.Ui)
+	)
+	instanceName := state.Get("instance_name").(string)
+	zone := state.Get("zone").(string)
+	ui.Say("Deleting instance...")
+	operation, err := client.DeleteInstance(zone, instanceName)
+	if err == nil {
+		ui.Say("Waiting for the instance to be deleted...")
+		err = waitForZoneOperationState("DONE", zone, operation.Name, client, config.stateTimeout, cancelChannel(state))
+	} else if isNotFound(err) {
+		// A retried delete fails this way when the response to an earlier
+		// attempt was lost, so the instance is already gone.
+		err = nil
+	}
+	if err != nil {
+		err := fmt.Errorf("Error deleting instance: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	// The instance is gone; there is nothing left for stepCreateInstance
+	// to clean up.
+	state.Put("instance_name", "")
+	return multistep.ActionContinue
+}
+
+// Cleanup.
+func (s *stepTeardownInstance) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,46 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepTeardownInstance(t *testing.T) {
+	client := NewFakeComputeAPI("hashicorp")
+	state := testInstanceState(t, testConfig(), client)
+	diskName := state.Get("disk_name").(string)
+
+	step := new(stepTeardownInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(client.Instances) != 0 {
+		t.Fatalf("the instance was not deleted: %v", client.Instances)
+	}
+	if _, ok := client.Disks[diskName]; !ok {
+		t.Fatal("the boot disk should be kept")
+	}
+	if name := state.Get("instance_name").(string); name != "" {
+		t.Fatalf("instance_name should be cleared: %s", name)
+	}
+}
+
+func TestStepTeardownInstance_notFound(t *testing.T) {
+	client := NewFakeComputeAPI("hashicorp")
+	state := testInstanceState(t, testConfig(), client)
+	// An earlier attempt deleted the instance, but its response was lost.
+	delete(client.Instances, state.Get("instance_name").(string))
+
+	step := new(stepTeardownInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %v", action, state.Get("error"))
+	}
+	if name := state.Get("instance_name").(string); name != "" {
+		t.Fatalf("instance_name should be cleared: %s", name)
+	}
+}
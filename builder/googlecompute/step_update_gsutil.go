@@ -24,7 +24,6 @@ type stepUpdateGsutil int
 func (s *stepUpdateGsutil) Run(state multistep.StateBag) multistep.StepAction {
 	var (
 		config     = state.Get("config").(config)
-		comm       = state.Get("communicator").(packer.Communicator)
 		sudoPrefix = ""
 		ui         = state.Get("ui").(packer.Ui)
 	)
@@ -35,7 +34,7 @@ func (s *stepUpdateGsutil) Run(state multistep.StateBag) multistep.StepAction {
 	gsutilUpdateCmd := "/usr/local/bin/gsutil update -n -f"
 	cmd := new(packer.RemoteCmd)
 	cmd.Command = fmt.Sprintf("%s%s", sudoPrefix, gsutilUpdateCmd)
-	err := cmd.StartWithUi(comm, ui)
+	err := runRemoteCmd(state, cmd)
 	if err != nil {
 		err := fmt.Errorf("Error updating gsutil: %s", err)
 		state.Put("error", err)
@@ -18,7 +18,6 @@ type stepUploadImage int
 func (s *stepUploadImage) Run(state multistep.StateBag) multistep.StepAction {
 	var (
 		config        = state.Get("config").(config)
-		comm          = state.Get("communicator").(packer.Communicator)
 		sudoPrefix    = ""
 		ui            = state.Get("ui").(packer.Ui)
 		imageFilename = state.Get("image_file_name").(string)
@@ -27,10 +26,15 @@ func (s *stepUploadImage) Run(state multistep.StateBag) multistep.StepAction {
 	if config.SSHUsername != "root" {
 		sudoPrefix = "sudo "
 	}
+	// Tarballs cannot be labelled, so the build labels are added as
+	// custom metadata of the object.
+	labels := buildLabels(state)
+	headers := fmt.Sprintf("-h x-goog-meta-%s:%s -h x-goog-meta-%s:%s",
+		buildIdLabel, labels[buildIdLabel], createdLabel, labels[createdLabel])
 	cmd := new(packer.RemoteCmd)
-	cmd.Command = fmt.Sprintf("%s/usr/local/bin/gsutil cp %s gs://%s",
-		sudoPrefix, imageFilename, config.BucketName)
-	err := cmd.StartWithUi(comm, ui)
+	cmd.Command = fmt.Sprintf("%s/usr/local/bin/gsutil %s cp %s gs://%s",
+		sudoPrefix, headers, imageFilename, config.BucketName)
+	err := runRemoteCmd(state, cmd)
 	if err != nil {
 		err := fmt.Errorf("Error uploading image: %s", err)
 		state.Put("error", err)
@@ -0,0 +1,92 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"net/http"
+
+	"google.golang.org/api/storage/v1"
+)
+
+// StorageAPI represents the Google Cloud Storage operations used to reap
+// the tarballs uploaded by builds. It is implemented by
+// *GoogleStorageClient.
+type StorageAPI interface {
+	// ListObjects returns the objects in the named bucket.
+	ListObjects(bucket string) ([]*storage.Object, error)
+
+	// DeleteObject deletes the named object in bucket.
+	DeleteObject(bucket, name string) error
+}
+
+var _ StorageAPI = new(GoogleStorageClient)
+
+// GoogleStorageClient represents a Google Cloud Storage client.
+type GoogleStorageClient struct {
+	Service *storage.Service
+	// retries controls how calls failing with transient errors are
+	// retried. The default policy is used when nil.
+	retries *retryPolicy
+}
+
+// NewStorage initializes and returns a *GoogleStorageClient. When endpoint
+// is not empty it replaces the base URL of the Storage API, e.g.
+// https://www.googleapis.com/storage/v1/.
+func NewStorage(endpoint string, ts tokenSource) (*GoogleStorageClient, error) {
+	transport := &tokenTransport{source: ts}
+	if _, err := transport.Token(nil); err != nil {
+		return nil, err
+	}
+	s, err := storage.New(&http.Client{Transport: transport})
+	if err != nil {
+		return nil, err
+	}
+	if endpoint != "" {
+		s.BasePath = endpoint
+	}
+	return &GoogleStorageClient{Service: s}, nil
+}
+
+// retry calls f according to the client's retry policy.
+func (g *GoogleStorageClient) retry(name string, idempotent bool, f func() error) error {
+	policy := g.retries
+	if policy == nil {
+		policy = defaultRetryPolicy()
+	}
+	return policy.do(name, idempotent, nil, f)
+}
+
+// ListObjects returns the objects in the named bucket.
+func (g *GoogleStorageClient) ListObjects(bucket string) ([]*storage.Object, error) {
+	var objects []*storage.Object
+	pageToken := ""
+	for {
+		objectsListCall := g.Service.Objects.List(bucket)
+		if pageToken != "" {
+			objectsListCall.PageToken(pageToken)
+		}
+		var objectList *storage.Objects
+		err := g.retry("ListObjects", true, func() (err error) {
+			objectList, err = objectsListCall.Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, objectList.Items...)
+		if objectList.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = objectList.NextPageToken
+	}
+}
+
+// DeleteObject deletes the named object in bucket.
+func (g *GoogleStorageClient) DeleteObject(bucket, name string) error {
+	objectsDeleteCall := g.Service.Objects.Delete(bucket, name)
+	return g.retry("DeleteObject", true, func() error {
+		return objectsDeleteCall.Do()
+	})
+}
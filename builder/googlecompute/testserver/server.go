@@ -0,0 +1,830 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// The testserver package contains a fake Google Compute Engine and Google
+// Cloud Storage HTTP server for end-to-end tests of the googlecompute
+// builder. It speaks enough of both REST APIs for a build to run against it:
+// zones, machine types, networks, images, instances, disks, operations and
+// storage objects. It also serves the GCE metadata token endpoint so the
+// builder can authenticate without key files.
+package testserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// The path prefixes of the Compute and Storage APIs served by the test
+// server.
+const (
+	computePath = "/compute/v1/projects/"
+	storagePath = "/storage/v1/"
+)
+
+// Request records a request received by the test server.
+type Request struct {
+	Method string
+	Path   string
+	Body   []byte
+}
+
+// Server is a fake GCE and GCS server.
+type Server struct {
+	// URL is the base URL of the server, e.g. http://127.0.0.1:1234.
+	URL       string
+	ProjectId string
+
+	server *httptest.Server
+
+	mu           sync.Mutex
+	requests     []Request
+	zones        map[string]*compute.Zone
+	machineTypes map[string]*compute.MachineType
+	networks     map[string]*compute.Network
+	images       map[string]*compute.Image
+	publicImages map[string]map[string]*compute.Image
+	// sharedNetworks holds the networks of other projects, keyed by project
+	// and name. subnetworks is keyed by project, region and name.
+	sharedNetworks map[string]*compute.Network
+	subnetworks    map[string]*compute.Subnetwork
+	exhaustedZones map[string]bool
+	instances      map[string]*compute.Instance
+	disks          map[string]*compute.Disk
+	operations     map[string]*compute.Operation
+	objects        map[string]*object
+	// failures holds, by HTTP method, the number of requests still to be
+	// failed with a transient error.
+	failures map[string]int
+	nextId   int
+}
+
+// object is a storage object and its custom metadata.
+type object struct {
+	data     []byte
+	metadata map[string]string
+}
+
+// NewServer starts and returns a new Server for projectId. The server knows
+// about the us-central1-a zone, the n1-standard-1 machine type, the default
+// network and the debian-7-wheezy-v20131014 image. Call Close when done.
+func NewServer(projectId string) *Server {
+	s := &Server{
+		ProjectId:      projectId,
+		zones:          make(map[string]*compute.Zone),
+		machineTypes:   make(map[string]*compute.MachineType),
+		networks:       make(map[string]*compute.Network),
+		images:         make(map[string]*compute.Image),
+		publicImages:   make(map[string]map[string]*compute.Image),
+		sharedNetworks: make(map[string]*compute.Network),
+		subnetworks:    make(map[string]*compute.Subnetwork),
+		exhaustedZones: make(map[string]bool),
+		instances:      make(map[string]*compute.Instance),
+		disks:          make(map[string]*compute.Disk),
+		operations:     make(map[string]*compute.Operation),
+		objects:        make(map[string]*object),
+		failures:       make(map[string]int),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	s.zones["us-central1-a"] = &compute.Zone{
+		Name:     "us-central1-a",
+		Region:   s.link("regions/us-central1"),
+		SelfLink: s.link("zones/us-central1-a"),
+		Status:   "UP",
+	}
+	s.machineTypes["n1-standard-1"] = &compute.MachineType{
+		Name:     "n1-standard-1",
+		SelfLink: s.link("zones/us-central1-a/machineTypes/n1-standard-1"),
+		Zone:     "us-central1-a",
+	}
+	s.networks["default"] = &compute.Network{
+		Name:     "default",
+		SelfLink: s.link("global/networks/default"),
+	}
+	s.images["debian-7-wheezy-v20131014"] = &compute.Image{
+		DiskSizeGb: 10,
+		Name:       "debian-7-wheezy-v20131014",
+		SelfLink:   s.link("global/images/debian-7-wheezy-v20131014"),
+		Status:     "READY",
+	}
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// ComputeEndpoint returns the base path of the Compute API, suitable for the
+// builder's compute_endpoint.
+func (s *Server) ComputeEndpoint() string {
+	return s.URL + computePath
+}
+
+// StorageEndpoint returns the base path of the Storage API.
+func (s *Server) StorageEndpoint() string {
+	return s.URL + storagePath
+}
+
+// MetadataHost returns the host of the metadata server, suitable for the
+// GCE_METADATA_HOST environment variable.
+func (s *Server) MetadataHost() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// Requests returns every request received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Image returns the named image, or nil.
+func (s *Server) Image(name string) *compute.Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.images[name]
+}
+
+// AddImage adds image to the project, setting its self link.
+func (s *Server) AddImage(image *compute.Image) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image.SelfLink = s.link("global/images/" + image.Name)
+	s.images[image.Name] = image
+}
+
+// AddPublicImage adds image to another project, such as a public image
+// project, setting its self link. Only the images of other projects are
+// served for them.
+func (s *Server) AddPublicImage(project string, image *compute.Image) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image.SelfLink = s.URL + computePath + project + "/global/images/" + image.Name
+	if s.publicImages[project] == nil {
+		s.publicImages[project] = make(map[string]*compute.Image)
+	}
+	s.publicImages[project][image.Name] = image
+}
+
+// AddNetwork adds network to project, setting its self link. The project
+// may be another project, such as a Shared VPC host project.
+func (s *Server) AddNetwork(project string, network *compute.Network) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	network.SelfLink = s.URL + computePath + project + "/global/networks/" + network.Name
+	if project == s.ProjectId {
+		s.networks[network.Name] = network
+	} else {
+		s.sharedNetworks[project+"/"+network.Name] = network
+	}
+}
+
+// AddSubnetwork adds subnetwork to the region of project, setting its self
+// link and region.
+func (s *Server) AddSubnetwork(project, region string, subnetwork *compute.Subnetwork) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subnetwork.Region = s.URL + computePath + project + "/regions/" + region
+	subnetwork.SelfLink = subnetwork.Region + "/subnetworks/" + subnetwork.Name
+	s.subnetworks[project+"/"+region+"/"+subnetwork.Name] = subnetwork
+}
+
+// Instances returns the names of all instances.
+func (s *Server) Instances() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.instances {
+		names = append(names, name)
+	}
+	return names
+}
+
+// AddZone adds the named zone to the project.
+func (s *Server) AddZone(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones[name] = &compute.Zone{
+		Name:     name,
+		Region:   s.link("regions/" + name[:strings.LastIndex(name, "-")]),
+		SelfLink: s.link("zones/" + name),
+		Status:   "UP",
+	}
+}
+
+// FailNext makes the next n requests with the given HTTP method fail with a
+// transient error.
+func (s *Server) FailNext(method string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] += n
+}
+
+// ExhaustZone makes instance creation in the named zone fail as if the zone
+// had run out of resources.
+func (s *Server) ExhaustZone(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exhaustedZones[name] = true
+}
+
+// Preempt terminates the named instance as if it had been preempted.
+func (s *Server) Preempt(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if instance, ok := s.instances[name]; ok {
+		instance.Status = "TERMINATED"
+	}
+}
+
+// Disks returns the names of all disks.
+func (s *Server) Disks() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.disks {
+		names = append(names, name)
+	}
+	return names
+}
+
+// PutObject stores an object in the named bucket.
+func (s *Server) PutObject(bucket, name string, data []byte) {
+	s.PutObjectMetadata(bucket, name, data, nil)
+}
+
+// PutObjectMetadata stores an object with custom metadata in the named
+// bucket.
+func (s *Server) PutObjectMetadata(bucket, name string, data []byte, metadata map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+name] = &object{data: data, metadata: metadata}
+}
+
+// Objects returns the names of all objects in the named bucket.
+func (s *Server) Objects(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, bucket+"/") {
+			names = append(names, strings.TrimPrefix(key, bucket+"/"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// link returns the self link of a resource in the project.
+func (s *Server) link(path string) string {
+	return s.URL + computePath + s.ProjectId + "/" + path
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Body: body})
+	if s.failures[r.Method] > 0 {
+		s.failures[r.Method]--
+		writeError(w, http.StatusServiceUnavailable, "backendError", "Backend Error")
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/computeMetadata/v1/"):
+		s.serveMetadata(w, r)
+	case strings.HasPrefix(r.URL.Path, computePath):
+		s.serveCompute(w, r, body)
+	case strings.HasPrefix(r.URL.Path, storagePath+"b/"):
+		s.serveStorage(w, r)
+	case strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		s.serveUpload(w, r, body)
+	default:
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+	}
+}
+
+// serveMetadata serves the metadata server token endpoint.
+func (s *Server) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Metadata-Flavor", "Google")
+	if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+		fmt.Fprint(w, `{"access_token":"testserver","expires_in":3600,"token_type":"Bearer"}`)
+	}
+}
+
+// serveCompute serves the Compute API.
+func (s *Server) serveCompute(w http.ResponseWriter, r *http.Request, body []byte) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, computePath), "/")
+	if len(parts) == 5 && parts[1] == "regions" && parts[3] == "subnetworks" && r.Method == "GET" {
+		getResource(w, s.subnetworks, strings.Join([]string{parts[0], parts[2], parts[4]}, "/"))
+		return
+	}
+	if parts[0] != s.ProjectId && r.Method == "GET" {
+		switch {
+		case len(parts) == 4 && parts[1] == "global" && parts[2] == "images":
+			getResource(w, s.publicImages[parts[0]], parts[3])
+			return
+		case len(parts) == 3 && parts[1] == "global" && parts[2] == "images":
+			listImages(w, s.publicImages[parts[0]], r.URL.Query().Get("filter"))
+			return
+		case len(parts) == 4 && parts[1] == "global" && parts[2] == "networks":
+			getResource(w, s.sharedNetworks, parts[0]+"/"+parts[3])
+			return
+		}
+	}
+	if len(parts) < 3 || parts[0] != s.ProjectId {
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+		return
+	}
+	parts = parts[1:]
+	if parts[0] == "global" {
+		s.serveGlobal(w, r, body, parts[1:])
+		return
+	}
+	if parts[0] != "zones" {
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+		return
+	}
+	zone, ok := s.zones[parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "The resource 'zones/"+parts[1]+"' was not found")
+		return
+	}
+	parts = parts[2:]
+	if len(parts) == 0 {
+		writeJSON(w, zone)
+		return
+	}
+	switch parts[0] {
+	case "machineTypes":
+		if len(parts) == 2 && r.Method == "GET" {
+			getResource(w, s.machineTypes, parts[1])
+			return
+		}
+	case "instances":
+		s.serveInstances(w, r, body, zone.Name, parts[1:])
+		return
+	case "disks":
+		s.serveDisks(w, r, body, zone.Name, parts[1:])
+		return
+	case "operations":
+		if len(parts) == 2 && r.Method == "GET" {
+			getResource(w, s.operations, parts[1])
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+}
+
+// serveGlobal serves global Compute resources.
+func (s *Server) serveGlobal(w http.ResponseWriter, r *http.Request, body []byte, parts []string) {
+	switch {
+	case len(parts) == 2 && parts[0] == "networks" && r.Method == "GET":
+		getResource(w, s.networks, parts[1])
+	case len(parts) == 2 && parts[0] == "operations" && r.Method == "GET":
+		getResource(w, s.operations, parts[1])
+	case len(parts) == 2 && parts[0] == "images" && r.Method == "GET":
+		getResource(w, s.images, parts[1])
+	case len(parts) == 1 && parts[0] == "images" && r.Method == "GET":
+		listImages(w, s.images, r.URL.Query().Get("filter"))
+	case len(parts) == 2 && parts[0] == "images" && r.Method == "DELETE":
+		if _, ok := s.images[parts[1]]; !ok {
+			writeError(w, http.StatusNotFound, "notFound", "The resource 'images/"+parts[1]+"' was not found")
+			return
+		}
+		delete(s.images, parts[1])
+		writeJSON(w, s.operation("delete", "", nil))
+	case len(parts) == 1 && parts[0] == "images" && r.Method == "POST":
+		var image *compute.Image
+		if err := json.Unmarshal(body, &image); err != nil || image == nil || image.Name == "" {
+			writeError(w, http.StatusBadRequest, "invalid", "Invalid image")
+			return
+		}
+		if _, ok := s.images[image.Name]; ok {
+			writeError(w, http.StatusConflict, "alreadyExists", "The resource 'images/"+image.Name+"' already exists")
+			return
+		}
+		if err := s.checkImageSource(image); err != nil {
+			writeJSON(w, s.operation("insert", "", err))
+			return
+		}
+		image.SelfLink = s.link("global/images/" + image.Name)
+		image.Status = "READY"
+		s.images[image.Name] = image
+		writeJSON(w, s.operation("insert", "", nil))
+	default:
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+	}
+}
+
+// listImages writes the images matching filter. Only filters of the form
+// "family eq NAME" are supported.
+func listImages(w http.ResponseWriter, images map[string]*compute.Image, filter string) {
+	family := ""
+	if filter != "" {
+		fields := strings.Fields(filter)
+		if len(fields) != 3 || fields[0] != "family" || fields[1] != "eq" {
+			writeError(w, http.StatusBadRequest, "invalid", "Invalid filter: "+filter)
+			return
+		}
+		family = fields[2]
+	}
+	list := &compute.ImageList{}
+	for _, image := range images {
+		if family == "" || image.Family == family {
+			list.Items = append(list.Items, image)
+		}
+	}
+	writeJSON(w, list)
+}
+
+// checkImageSource verifies the source of a new image exists.
+func (s *Server) checkImageSource(image *compute.Image) error {
+	switch {
+	case image.RawDisk != nil:
+		if image.RawDisk.ContainerType != "TAR" {
+			return fmt.Errorf("Invalid rawDisk.containerType: %q", image.RawDisk.ContainerType)
+		}
+		const prefix = "https://storage.cloud.google.com/"
+		if !strings.HasPrefix(image.RawDisk.Source, prefix) {
+			return fmt.Errorf("Invalid rawDisk.source: %q", image.RawDisk.Source)
+		}
+		if _, ok := s.objects[strings.TrimPrefix(image.RawDisk.Source, prefix)]; !ok {
+			return fmt.Errorf("The object %q was not found", image.RawDisk.Source)
+		}
+	case image.SourceDisk != "":
+		for _, disk := range s.disks {
+			if disk.SelfLink == image.SourceDisk {
+				for _, instance := range s.instances {
+					for _, attached := range instance.Disks {
+						if attached.Source == disk.SelfLink {
+							return fmt.Errorf("The disk %q is in use by %q", disk.Name, instance.Name)
+						}
+					}
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("The disk %q was not found", image.SourceDisk)
+	default:
+		return fmt.Errorf("Image %q has no source", image.Name)
+	}
+	return nil
+}
+
+// serveInstances serves zonal instances.
+func (s *Server) serveInstances(w http.ResponseWriter, r *http.Request, body []byte, zone string, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		list := &compute.InstanceList{}
+		for _, instance := range s.instances {
+			if instance.Zone == zone {
+				list.Items = append(list.Items, instance)
+			}
+		}
+		writeJSON(w, list)
+	case len(parts) == 1 && r.Method == "GET":
+		getResource(w, s.instances, parts[0])
+	case len(parts) == 1 && r.Method == "DELETE":
+		if _, ok := s.instances[parts[0]]; !ok {
+			writeError(w, http.StatusNotFound, "notFound", "The resource 'instances/"+parts[0]+"' was not found")
+			return
+		}
+		for _, attached := range s.instances[parts[0]].Disks {
+			for name, disk := range s.disks {
+				if disk.SelfLink != attached.Source {
+					continue
+				}
+				if attached.AutoDelete {
+					delete(s.disks, name)
+				} else {
+					disk.Users = nil
+				}
+			}
+		}
+		delete(s.instances, parts[0])
+		writeJSON(w, s.operation("delete", zone, nil))
+	case len(parts) == 0 && r.Method == "POST":
+		var instance *compute.Instance
+		if err := json.Unmarshal(body, &instance); err != nil || instance == nil || instance.Name == "" {
+			writeError(w, http.StatusBadRequest, "invalid", "Invalid instance")
+			return
+		}
+		if _, ok := s.instances[instance.Name]; ok {
+			writeError(w, http.StatusConflict, "alreadyExists", "The resource 'instances/"+instance.Name+"' already exists")
+			return
+		}
+		if s.exhaustedZones[zone] {
+			err := &codedError{
+				code:    "ZONE_RESOURCE_POOL_EXHAUSTED",
+				message: "The zone '" + zone + "' does not have enough resources available to fulfill the request.",
+			}
+			writeJSON(w, s.operation("insert", zone, err))
+			return
+		}
+		if err := s.createInstanceDisks(zone, instance); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		s.nextId++
+		instance.SelfLink = s.link("zones/" + zone + "/instances/" + instance.Name)
+		instance.Status = "RUNNING"
+		instance.Zone = zone
+		for _, ni := range instance.NetworkInterfaces {
+			ni.NetworkIP = fmt.Sprintf("10.240.0.%d", s.nextId)
+			for _, ac := range ni.AccessConfigs {
+				if ac.Type == "ONE_TO_ONE_NAT" {
+					ac.NatIP = fmt.Sprintf("192.0.2.%d", s.nextId)
+				}
+			}
+		}
+		s.instances[instance.Name] = instance
+		writeJSON(w, s.operation("insert", zone, nil))
+	default:
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+	}
+}
+
+// createInstanceDisks creates the disks described by the InitializeParams
+// of a new instance and attaches them by self link. An instance must have
+// exactly one boot disk.
+func (s *Server) createInstanceDisks(zone string, instance *compute.Instance) error {
+	boot := 0
+	for _, attached := range instance.Disks {
+		if attached.Boot {
+			boot++
+		}
+		p := attached.InitializeParams
+		if p == nil {
+			if attached.Source == "" {
+				return fmt.Errorf("Disk %d has neither a source nor initializeParams", attached.Index)
+			}
+			continue
+		}
+		var source *compute.Image
+		for _, image := range s.images {
+			if image.SelfLink == p.SourceImage {
+				source = image
+			}
+		}
+		for _, images := range s.publicImages {
+			for _, image := range images {
+				if image.SelfLink == p.SourceImage {
+					source = image
+				}
+			}
+		}
+		if source == nil {
+			return fmt.Errorf("The source image %q was not found", p.SourceImage)
+		}
+		if p.DiskSizeGb != 0 && p.DiskSizeGb < source.DiskSizeGb {
+			return fmt.Errorf("Requested disk size cannot be smaller than the image size (%d GB)", source.DiskSizeGb)
+		}
+		name := p.DiskName
+		if name == "" {
+			name = instance.Name
+		}
+		if _, ok := s.disks[name]; ok {
+			return fmt.Errorf("The resource 'disks/%s' already exists", name)
+		}
+		s.disks[name] = &compute.Disk{
+			Labels:      p.Labels,
+			Name:        name,
+			SelfLink:    s.link("zones/" + zone + "/disks/" + name),
+			SizeGb:      p.DiskSizeGb,
+			SourceImage: p.SourceImage,
+			Status:      "READY",
+			Type:        p.DiskType,
+			Users:       []string{s.link("zones/" + zone + "/instances/" + instance.Name)},
+			Zone:        zone,
+		}
+		attached.Source = s.disks[name].SelfLink
+		attached.InitializeParams = nil
+	}
+	if boot != 1 {
+		return fmt.Errorf("Instance %q must have exactly one boot disk, got %d", instance.Name, boot)
+	}
+	return nil
+}
+
+// serveDisks serves zonal persistent disks.
+func (s *Server) serveDisks(w http.ResponseWriter, r *http.Request, body []byte, zone string, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		list := &compute.DiskList{}
+		for _, disk := range s.disks {
+			if disk.Zone == zone {
+				list.Items = append(list.Items, disk)
+			}
+		}
+		writeJSON(w, list)
+	case len(parts) == 1 && r.Method == "GET":
+		getResource(w, s.disks, parts[0])
+	case len(parts) == 1 && r.Method == "DELETE":
+		if _, ok := s.disks[parts[0]]; !ok {
+			writeError(w, http.StatusNotFound, "notFound", "The resource 'disks/"+parts[0]+"' was not found")
+			return
+		}
+		delete(s.disks, parts[0])
+		writeJSON(w, s.operation("delete", zone, nil))
+	case len(parts) == 0 && r.Method == "POST":
+		var disk *compute.Disk
+		if err := json.Unmarshal(body, &disk); err != nil || disk == nil || disk.Name == "" {
+			writeError(w, http.StatusBadRequest, "invalid", "Invalid disk")
+			return
+		}
+		if _, ok := s.disks[disk.Name]; ok {
+			writeError(w, http.StatusConflict, "alreadyExists", "The resource 'disks/"+disk.Name+"' already exists")
+			return
+		}
+		disk.SourceImage = r.URL.Query().Get("sourceImage")
+		disk.SelfLink = s.link("zones/" + zone + "/disks/" + disk.Name)
+		disk.Status = "READY"
+		disk.Zone = zone
+		s.disks[disk.Name] = disk
+		writeJSON(w, s.operation("insert", zone, nil))
+	default:
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+	}
+}
+
+// serveStorage serves storage object listing, metadata and deletion.
+func (s *Server) serveStorage(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, storagePath+"b/"), "/", 3)
+	if len(parts) == 2 && parts[1] == "o" && r.Method == "GET" {
+		var items []interface{}
+		var names []string
+		for key := range s.objects {
+			if strings.HasPrefix(key, parts[0]+"/") {
+				names = append(names, strings.TrimPrefix(key, parts[0]+"/"))
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			items = append(items, s.objectResource(parts[0], name))
+		}
+		writeJSON(w, map[string]interface{}{
+			"kind":  "storage#objects",
+			"items": items,
+		})
+		return
+	}
+	if len(parts) != 3 || parts[1] != "o" {
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+		return
+	}
+	key := parts[0] + "/" + parts[2]
+	if _, ok := s.objects[key]; !ok {
+		writeError(w, http.StatusNotFound, "notFound", "No such object: "+key)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, s.objectResource(parts[0], parts[2]))
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "invalid", "Method not allowed")
+	}
+}
+
+// serveUpload serves simple media uploads of storage objects.
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, body []byte) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/")
+	name := r.URL.Query().Get("name")
+	if len(parts) != 2 || parts[1] != "o" || r.Method != "POST" || name == "" {
+		writeError(w, http.StatusBadRequest, "invalid", "Invalid upload")
+		return
+	}
+	s.objects[parts[0]+"/"+name] = &object{data: body}
+	writeJSON(w, s.objectResource(parts[0], name))
+}
+
+// objectResource returns the JSON resource of the named object.
+func (s *Server) objectResource(bucket, name string) map[string]interface{} {
+	o := s.objects[bucket+"/"+name]
+	return map[string]interface{}{
+		"bucket":   bucket,
+		"metadata": o.metadata,
+		"name":     name,
+		"selfLink": s.URL + storagePath + "b/" + bucket + "/o/" + name,
+		"size":     fmt.Sprint(len(o.data)),
+	}
+}
+
+// operation records and returns a completed operation. A non-nil err is
+// reported as the operation's error.
+func (s *Server) operation(kind, zone string, err error) *compute.Operation {
+	s.nextId++
+	o := &compute.Operation{
+		Name:          fmt.Sprintf("operation-%d", s.nextId),
+		OperationType: kind,
+		Status:        "DONE",
+		Zone:          zone,
+	}
+	if err != nil {
+		code := "INVALID"
+		if e, ok := err.(*codedError); ok {
+			code = e.code
+		}
+		o.Error = &compute.OperationError{
+			Errors: []*compute.OperationErrorErrors{
+				{Code: code, Message: err.Error()},
+			},
+		}
+	}
+	if zone != "" {
+		o.SelfLink = s.link("zones/" + zone + "/operations/" + o.Name)
+	} else {
+		o.SelfLink = s.link("global/operations/" + o.Name)
+	}
+	s.operations[o.Name] = o
+	return o
+}
+
+// codedError is an operation error with a specific error code.
+type codedError struct {
+	code    string
+	message string
+}
+
+func (e *codedError) Error() string {
+	return e.message
+}
+
+// getResource writes the named resource from resources, a map of names to
+// resources, or a 404 error.
+func getResource(w http.ResponseWriter, resources interface{}, name string) {
+	var resource interface{}
+	switch m := resources.(type) {
+	case map[string]*compute.MachineType:
+		if v, ok := m[name]; ok {
+			resource = v
+		}
+	case map[string]*compute.Network:
+		if v, ok := m[name]; ok {
+			resource = v
+		}
+	case map[string]*compute.Subnetwork:
+		if v, ok := m[name]; ok {
+			resource = v
+		}
+	case map[string]*compute.Image:
+		if v, ok := m[name]; ok {
+			resource = v
+		}
+	case map[string]*compute.Instance:
+		if v, ok := m[name]; ok {
+			resource = v
+		}
+	case map[string]*compute.Disk:
+		if v, ok := m[name]; ok {
+			resource = v
+		}
+	case map[string]*compute.Operation:
+		if v, ok := m[name]; ok {
+			resource = v
+		}
+	}
+	if resource == nil {
+		writeError(w, http.StatusNotFound, "notFound", "The resource '"+name+"' was not found")
+		return
+	}
+	writeJSON(w, resource)
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a Google API error response.
+func writeError(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors": []map[string]string{
+				{"domain": "global", "reason": reason, "message": message},
+			},
+		},
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenExpiryDelta is how long before its expiry a token is replaced.
+const tokenExpiryDelta = 60 * time.Second
+
+// tokenTransport is an http.RoundTripper that authorizes requests with an
+// access token from source. The token is fetched again shortly before it
+// expires, and a request rejected with 401 Unauthorized is retried once with
+// a fresh token.
+type tokenTransport struct {
+	source    tokenSource
+	transport http.RoundTripper
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// Token returns the current access token, fetching a new one if there is
+// none or it is about to expire. When stale is the current token, a new one
+// is fetched regardless of its expiry.
+func (t *tokenTransport) Token(stale *oauth2.Token) (*oauth2.Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != nil && t.token != stale && !expiresSoon(t.token) {
+		return t.token, nil
+	}
+	log.Println("Fetching a new access token...")
+	token, err := t.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	t.token = token
+	return token, nil
+}
+
+// RoundTrip authorizes and sends req.
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.Token(nil)
+	if err != nil {
+		return nil, err
+	}
+	// Keep a copy of the body so the request can be sent a second time.
+	var body []byte
+	if req.Body != nil {
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.send(req, body, token)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	log.Printf("Request to %s was unauthorized, retrying with a new token", req.URL)
+	token, err = t.Token(token)
+	if err != nil {
+		return nil, err
+	}
+	return t.send(req, body, token)
+}
+
+// send clones req, sets its Authorization header and body and sends it.
+func (t *tokenTransport) send(req *http.Request, body []byte, token *oauth2.Token) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(r)
+}
+
+// expiresSoon reports whether token expires within tokenExpiryDelta. Tokens
+// without an expiry never expire.
+func expiresSoon(token *oauth2.Token) bool {
+	if token.Expiry.IsZero() {
+		return false
+	}
+	return token.Expiry.Before(time.Now().Add(tokenExpiryDelta))
+}
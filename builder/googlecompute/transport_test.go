@@ -0,0 +1,119 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package googlecompute
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// countingTokenSource hands out numbered tokens with a fixed lifetime.
+type countingTokenSource struct {
+	calls    int
+	lifetime time.Duration
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.calls++
+	return &oauth2.Token{
+		AccessToken: fmt.Sprintf("token-%d", s.calls),
+		Expiry:      time.Now().Add(s.lifetime),
+	}, nil
+}
+
+func TestTokenTransport_reusesToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-1" {
+			t.Errorf("bad authorization: %s", r.Header.Get("Authorization"))
+		}
+	}))
+	defer server.Close()
+	source := &countingTokenSource{lifetime: time.Hour}
+	client := &http.Client{Transport: &tokenTransport{source: source}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		resp.Body.Close()
+	}
+	if source.calls != 1 {
+		t.Fatalf("expected 1 token fetch, got %d", source.calls)
+	}
+}
+
+func TestTokenTransport_refreshesBeforeExpiry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	// Every token is already within tokenExpiryDelta of expiring.
+	source := &countingTokenSource{lifetime: tokenExpiryDelta / 2}
+	client := &http.Client{Transport: &tokenTransport{source: source}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		resp.Body.Close()
+	}
+	if source.calls != 2 {
+		t.Fatalf("expected 2 token fetches, got %d", source.calls)
+	}
+}
+
+func TestTokenTransport_retriesUnauthorized(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	source := &countingTokenSource{lifetime: time.Hour}
+	client := &http.Client{Transport: &tokenTransport{source: source}}
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader(`{"name":"i"}`))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad status: %d", resp.StatusCode)
+	}
+	if source.calls != 2 {
+		t.Fatalf("expected 2 token fetches, got %d", source.calls)
+	}
+	if len(bodies) != 2 || bodies[1] != `{"name":"i"}` {
+		t.Fatalf("request body was not resent: %#v", bodies)
+	}
+}
+
+func TestTokenTransport_retriesUnauthorizedOnce(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &tokenTransport{source: &countingTokenSource{lifetime: time.Hour}}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad status: %d", resp.StatusCode)
+	}
+	if requests != 2 {
+		t.Fatalf("expected 2 requests, got %d", requests)
+	}
+}
@@ -13,32 +13,43 @@ import (
 // statusFunc.
 type statusFunc func() (string, error)
 
-// waitForInstanceState.
-func waitForInstanceState(desiredState string, zone string, name string, client *GoogleComputeClient, timeout time.Duration) error {
+// waitForInstanceState. An instance that terminates, e.g. because it was
+// preempted, fails the wait unless it is meant to terminate.
+func waitForInstanceState(desiredState string, zone string, name string, client ComputeAPI, timeout time.Duration, cancel <-chan struct{}) error {
 	f := func() (string, error) {
-		return client.InstanceStatus(zone, name)
+		status, err := client.InstanceStatus(zone, name)
+		if err == nil && status == "TERMINATED" && desiredState != "TERMINATED" {
+			return "", fmt.Errorf("Instance %s was terminated", name)
+		}
+		return status, err
 	}
-	return waitForState("instance", desiredState, f, timeout)
+	return waitForState("instance", desiredState, f, timeout, cancel)
 }
 
 // waitForZoneOperationState.
-func waitForZoneOperationState(desiredState string, zone string, name string, client *GoogleComputeClient, timeout time.Duration) error {
+func waitForZoneOperationState(desiredState string, zone string, name string, client ComputeAPI, timeout time.Duration, cancel <-chan struct{}) error {
 	f := func() (string, error) {
 		return client.ZoneOperationStatus(zone, name)
 	}
-	return waitForState("operation", desiredState, f, timeout)
+	return waitForState("operation", desiredState, f, timeout, cancel)
 }
 
 // waitForGlobalOperationState.
-func waitForGlobalOperationState(desiredState string, name string, client *GoogleComputeClient, timeout time.Duration) error {
+func waitForGlobalOperationState(desiredState string, name string, client ComputeAPI, timeout time.Duration, cancel <-chan struct{}) error {
 	f := func() (string, error) {
 		return client.GlobalOperationStatus(name)
 	}
-	return waitForState("operation", desiredState, f, timeout)
+	return waitForState("operation", desiredState, f, timeout, cancel)
 }
 
-// waitForState.
-func waitForState(kind string, desiredState string, f statusFunc, timeout time.Duration) error {
+// waitForState. The wait ends with errCancelled once cancel is closed; a nil
+// cancel, as used by cleanup, never ends it.
+func waitForState(kind string, desiredState string, f statusFunc, timeout time.Duration, cancel <-chan struct{}) error {
+	select {
+	case <-cancel:
+		return errCancelled
+	default:
+	}
 	done := make(chan struct{})
 	defer close(done)
 	result := make(chan error, 1)
@@ -56,12 +67,10 @@ func waitForState(kind string, desiredState string, f statusFunc, timeout time.D
 				result <- nil
 				return
 			}
-			time.Sleep(3 * time.Second)
 			select {
 			case <-done:
 				return
-			default:
-				continue
+			case <-time.After(3 * time.Second):
 			}
 		}
 	}()
@@ -69,6 +78,8 @@ func waitForState(kind string, desiredState string, f statusFunc, timeout time.D
 	select {
 	case err := <-result:
 		return err
+	case <-cancel:
+		return errCancelled
 	case <-time.After(timeout):
 		err := fmt.Errorf("Timeout while waiting to for the %s to become '%s'", kind, desiredState)
 		return err
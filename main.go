@@ -5,10 +5,46 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/kelseyhightower/packer-builder-googlecompute/builder/googlecompute"
 	"github.com/mitchellh/packer/packer/plugin"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reap" {
+		os.Exit(reap(os.Args[2:]))
+	}
 	plugin.ServeBuilder(new(googlecompute.Builder))
 }
+
+// reap runs the reap subcommand, which lists and deletes the instances,
+// disks and tarballs left behind by builds, and returns the exit status.
+func reap(args []string) int {
+	c := new(googlecompute.ReapConfig)
+	var zones string
+	flags := flag.NewFlagSet("reap", flag.ContinueOnError)
+	flags.StringVar(&c.AccountFile, "account-file", "", "The service account JSON key file. Defaults to Application Default Credentials.")
+	flags.StringVar(&c.ComputeEndpoint, "compute-endpoint", "", "The base URL of the Compute Engine API.")
+	flags.StringVar(&c.ProjectId, "project", "", "The project the builds ran in.")
+	flags.StringVar(&zones, "zones", "", "The comma-separated zones searched for instances and disks.")
+	flags.StringVar(&c.Bucket, "bucket", "", "The Cloud Storage bucket searched for tarballs.")
+	flags.DurationVar(&c.OlderThan, "older-than", 24*time.Hour, "The age from which resources are reaped.")
+	flags.BoolVar(&c.Delete, "delete", false, "Delete the resources found instead of only listing them.")
+	flags.DurationVar(&c.Timeout, "timeout", 5*time.Minute, "The time to wait for each resource to be deleted.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if zones != "" {
+		c.Zones = strings.Split(zones, ",")
+	}
+	if err := googlecompute.Reap(c, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}